@@ -2,69 +2,877 @@ package main
 
 import (
 	"bufio"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 // Тип для хранения информации о переменной
 type Variable struct {
-	isInt bool    // true, если переменная целая
-	value float64 // текущее числовое значение (даже для целых храним в float64, чтобы упрощать вычисления)
+	kind  ValueKind // число, массив, строка или функция
+	isInt bool      // true, если переменная целая
+	value float64   // текущее числовое значение (для целых – приближение ival)
+	ival  int64     // точное значение целой переменной
+	elems []Value   // элементы, если переменная – массив
+	str   string    // текст, если переменная – строка
+	fn    *Function // функция, если переменная хранит лямбду
 }
 
 // Тип для хранения информации о функции
 type Function struct {
-	params     []string // имена параметров
-	expression string   // строка-выражение (парсится при вычислении)
+	name       string  // имя, под которым функция объявлена
+	params     []Param // параметры
+	expression string  // строка-выражение (парсится при вычислении)
+
+	// Композиция compose(f, g): функции f и g, вызываемые как f(g(x));
+	// expression у такой функции служит только для вывода
+	composed []*Function
+
+	// Кэш результатов по значениям аргументов (команда memoize); nil – функция не кэшируется
+	memo map[string][]Value
+}
+
+// Параметр функции: имя и необязательный объявленный тип ("x:i" или "y:f")
+type Param struct {
+	name string
+	typ  string // "i", "f" или "" – без объявленного типа параметр вещественный
+}
+
+// bindArgs – приводит аргументы вызова к объявленным типам параметров:
+// целый параметр отбрасывает дробную часть аргумента, остальные числа
+// становятся float; массивы передаются только в параметры без типа
+func (fn *Function) bindArgs(args []Value) ([]Value, error) {
+	bound := make([]Value, len(args))
+	for i, arg := range args {
+		param := fn.params[i]
+		if param.typ != "" && arg.kind != KindNumber {
+			return nil, fmt.Errorf("параметр %s функции %s ожидает число", param.name, fn.name)
+		}
+		switch param.typ {
+		case "i":
+			n, ok := toInt(arg)
+			if !ok {
+				return nil, fmt.Errorf("число слишком большое для целого параметра %s: %g", param.name, arg.num)
+			}
+			arg = intValue(n)
+		default:
+			if arg.kind == KindNumber {
+				arg = Value{num: arg.num}
+			}
+		}
+		bound[i] = arg
+	}
+	return bound, nil
+}
+
+// Вид значения: число, массив чисел, строка или функция (лямбда)
+type ValueKind int
+
+const (
+	KindNumber ValueKind = iota
+	KindArray
+	KindString
+	KindFunction
+)
+
+// Результат вычисления выражения: число и его тип, массив, строка или функция
+type Value struct {
+	kind  ValueKind
+	num   float64
+	isInt bool      // true, если значение целое: целые литералы, целые переменные и операции над ними
+	ival  int64     // точное значение целого (только при isInt); num – его приближение
+	arr   []Value   // элементы массива (только для KindArray)
+	str   string    // текст строки (только для KindString)
+	fn    *Function // функция (только для KindFunction)
+}
+
+// Доступ к значению для встраивающих программ (см. Interpreter.Eval)
+
+// Kind – вид значения: число, массив, строка или функция
+func (v Value) Kind() ValueKind { return v.kind }
+
+// IsInt – true, если значение целое
+func (v Value) IsInt() bool { return v.isInt }
+
+// Float – числовое значение (для целых – приближение Int)
+func (v Value) Float() float64 { return v.num }
+
+// Int – точное значение целого; для вещественных – 0
+func (v Value) Int() int64 { return v.ival }
+
+// Elems – элементы массива; для остальных видов – nil
+func (v Value) Elems() []Value { return v.arr }
+
+// Str – текст строки; для остальных видов – пустая строка
+func (v Value) Str() string { return v.str }
+
+// String – текстовое представление, как в выводе print
+func (v Value) String() string { return formatValue(v) }
+
+// intValue – целое значение: точное int64 и его приближение float64
+// для операций, которые выполняются над вещественными числами
+func intValue(i int64) Value {
+	return Value{num: float64(i), isInt: true, ival: i}
+}
+
+// toInt – целая часть числа: точное значение для целых, дробная часть
+// вещественных отбрасывается; ok = false, если число не помещается в int64
+func toInt(v Value) (int64, bool) {
+	if v.isInt {
+		return v.ival, true
+	}
+	if !fitsInt64(v.num) {
+		return 0, false
+	}
+	return int64(v.num), true
+}
+
+// get – текущее значение переменной
+func (v *Variable) get() Value {
+	if v.kind == KindArray {
+		return Value{kind: KindArray, arr: v.elems}
+	}
+	if v.kind == KindString {
+		return Value{kind: KindString, str: v.str}
+	}
+	if v.kind == KindFunction {
+		return Value{kind: KindFunction, fn: v.fn}
+	}
+	if v.isInt {
+		return intValue(v.ival)
+	}
+	return Value{num: v.value}
+}
+
+// set – записывает число в переменную с учётом её типа (в целую – с отбрасыванием
+// дробной части); false, если число не помещается в целую переменную
+func (v *Variable) set(val Value) bool {
+	if !v.isInt {
+		v.value = val.num
+		return true
+	}
+	i, ok := toInt(val)
+	if !ok {
+		return false
+	}
+	v.ival, v.value = i, float64(i)
+	return true
+}
+
+// newVariable – переменная со значением val; массив копируется,
+// чтобы переменные не разделяли общие элементы
+func newVariable(val Value) *Variable {
+	if val.kind == KindArray {
+		return &Variable{kind: KindArray, elems: append([]Value{}, val.arr...)}
+	}
+	if val.kind == KindString {
+		return &Variable{kind: KindString, str: val.str}
+	}
+	if val.kind == KindFunction {
+		return &Variable{kind: KindFunction, fn: val.fn}
+	}
+	v := &Variable{isInt: val.isInt}
+	v.set(val)
+	return v
+}
+
+// typeName – название типа значения для вывода
+func typeName(v Value) string {
+	switch {
+	case v.kind == KindArray:
+		return "array"
+	case v.kind == KindString:
+		return "string"
+	case v.kind == KindFunction:
+		return "function"
+	case v.isInt:
+		return "int"
+	default:
+		return "float"
+	}
+}
+
+// formatValue – текстовое представление значения: целые без дробной части,
+// вещественные в формате %g, массивы – в квадратных скобках через запятую,
+// строки – как есть, без кавычек
+func formatValue(v Value) string {
+	if v.kind == KindString {
+		return v.str
+	}
+	if v.kind == KindFunction {
+		names := make([]string, len(v.fn.params))
+		for i, p := range v.fn.params {
+			names[i] = p.name
+		}
+		return "lambda(" + strings.Join(names, ", ") + "): " + v.fn.expression
+	}
+	if v.kind == KindArray {
+		parts := make([]string, len(v.arr))
+		for i, el := range v.arr {
+			parts[i] = formatValue(el)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	}
+	if v.isInt {
+		return strconv.FormatInt(v.ival, 10)
+	}
+	return fmt.Sprintf("%g", v.num)
+}
+
+// isWhole – число без дробной части, представимое в int64
+func isWhole(f float64) bool {
+	return fitsInt64(f) && float64(int64(f)) == f
+}
+
+// fitsInt64 – целая часть числа помещается в int64 (без переполнения при приведении)
+func fitsInt64(f float64) bool {
+	return f >= math.MinInt64 && f < math.MaxInt64
+}
+
+// Счётчики выполненных операций (для профилирования, флаг --stats)
+type OpStats struct {
+	additions       int // сложения
+	subtractions    int // вычитания
+	multiplications int // умножения
+	divisions       int // деления
+	powers          int // возведения в степень
+	calls           int // вызовы пользовательских функций (без взятых из кэша memoize)
+
+	statements       int // выполненные инструкции верхнего уровня (без пустых строк и комментариев)
+	failedStatements int // из них завершившиеся ошибкой
+
+	funcCalls map[string]int // вызовы по именам функций (с учётом рекурсии)
+
+	parses    int // разборы выражений (лексер и парсер)
+	cacheHits int // выражения, дерево которых взято из кэша без разбора
+}
+
+// funcProfile – время, проведённое в функции (флаг --profile). Время
+// включает вложенные вызовы других функций; рекурсивные вызовы не
+// учитываются повторно – считается только самый внешний вызов.
+type funcProfile struct {
+	total  time.Duration // суммарное время
+	calls  int           // число вызовов (с учётом рекурсии)
+	active int           // текущая глубина рекурсии функции
+}
+
+// Interpreter – состояние интерпретатора: переменные, функции, настройки и потоки вывода.
+// Все инструкции выполняются в контексте одного интерпретатора.
+type Interpreter struct {
+	variables map[string]*Variable
+	functions map[string]*Function
+
+	// Деревья разбора недавно вычислявшихся выражений (см. exprCache)
+	parsed *exprCache
+
+	// Области видимости тел циклов, от внешней к внутренней: для каждой – переменные,
+	// объявленные в ней командой let, и их прежние значения (nil – переменной не было).
+	// При выходе из тела прежние значения восстанавливаются, как параметры функций.
+	scopes []map[string]*Variable
+
+	// Стек вызовов: функции, вычисляемые в данный момент (последняя – самая внутренняя).
+	// Параметры функции живут в общей карте variables, поэтому стек нужен, чтобы
+	// отличать параметр текущего вызова от глобальной переменной.
+	callStack []*Function
+
+	In  io.Reader // ввод команды input (по умолчанию os.Stdin)
+	Out io.Writer // вывод команд print и других результатов (по умолчанию os.Stdout)
+	Err io.Writer // сообщения об ошибках (по умолчанию os.Stderr)
+
+	// Буферизованное чтение из In; создаётся при первом чтении строки
+	input *bufio.Reader
+
+	// Перенаправления вывода командой writeto: файл, в который идёт вывод,
+	// и предыдущий Out, восстанавливаемый командой "writeto;"
+	redirects []redirect
+
+	// Количество ошибок, возникших при выполнении; при ненулевом значении
+	// программа завершается с кодом 1
+	errorCount int
+
+	// Подсчёт операций включается только флагом --stats; при выключенном флаге
+	// вычислитель делает лишь одну проверку булевой переменной.
+	statsEnabled bool
+	stats        OpStats
+
+	// Время по функциям (флаг --profile); выводится в конце, самые медленные – первыми
+	profileEnabled bool
+	profile        map[string]*funcProfile
+
+	// Ограничение времени работы (флаг --max-runtime); 0 – без ограничения
+	maxRuntime time.Duration
+	startTime  time.Time
+
+	// Предупреждать о повторном объявлении функций и переменных (флаг --warn-redefine)
+	warnRedefine bool
+
+	// Разделитель значений в "print a, b, c" (флаг --print-sep)
+	printSep string
+
+	// Вывод результатов print в формате JSON (флаг --output json)
+	jsonOutput bool
+
+	// Файлы, обрабатываемые в данный момент (абсолютные пути): основной файл
+	// и подключённые через include; нужен для обнаружения циклов
+	files []string
+
+	// Наибольшее число повторений тела цикла (флаг --max-iterations)
+	maxIterations int
+
+	// Наибольшая глубина вложенных вызовов функций (флаг --max-depth)
+	maxDepth int
+
+	// Наибольшая длина строки файла инструкций в байтах (флаг --max-line-length)
+	maxLineLength int
+
+	// Наибольшее число переменных и, отдельно, функций (флаг --max-variables);
+	// 0 – без ограничения
+	maxVariables int
+
+	// Деление на ноль – ошибка, а не бесконечность (флаг --strict-div)
+	strictDiv bool
+
+	// Печатать вид каждой инструкции перед выполнением (флаг --verbose)
+	verbose bool
+
+	// Одиночный '=' внутри скобок – сравнение (флаг --eq-compat)
+	eqCompat bool
+
+	// Десятичная запятая во входных числах: 3,14 (флаг --locale ru)
+	decimalComma bool
+
+	// Выводить деревья разбора выражений вместо их вычисления (флаг --ast)
+	astOnly bool
+
+	// Смешение int и float в арифметике без явного приведения – ошибка (флаг --strict-types)
+	strictTypes bool
+
+	// Предупреждать о неизвестных именах в теле функции при её объявлении (флаг --check-functions)
+	checkFunctions bool
+
+	// Экспоненциальная запись вещественных в выводе (флаг --sci): для модулей
+	// не меньше sciThreshold и меньше 1/sciThreshold (флаг --sci-threshold)
+	sci          bool
+	sciThreshold float64
+
+	// Вещественные с модулем от 1 до plainMax выводятся без экспоненты:
+	// 1000000.0 -> 1000000, а не 1e+06 (флаг --plain-max; 0 – всегда как %g)
+	plainMax float64
+
+	// Выводить знак '+' у положительных чисел (флаг --sign)
+	showSign bool
+
+	// ANSI-цвета в выводе: ошибки – красным, результаты print, echo и show – зелёным
+	// (флаг --color; включается, только если вывод идёт в терминал)
+	color bool
+}
+
+// NewInterpreter – интерпретатор с пустым состоянием, читающий из os.Stdin
+// и выводящий в os.Stdout и os.Stderr
+func NewInterpreter() *Interpreter {
+	return &Interpreter{
+		variables: make(map[string]*Variable),
+		functions: make(map[string]*Function),
+		In:        os.Stdin,
+		Out:       os.Stdout,
+		Err:       os.Stderr,
+		startTime: time.Now(),
+		printSep:  " ",
+		maxDepth:  1000,
+
+		maxIterations: 1000000,
+		maxLineLength: 1 << 20,
+
+		sciThreshold: 1e6,
+		plainMax:     1e15,
+	}
+}
+
+// readLine – очередная строка ввода без перевода строки; false – ввод исчерпан
+func (in *Interpreter) readLine() (string, bool) {
+	if in.input == nil {
+		in.input = bufio.NewReader(in.In)
+	}
+	line, err := in.input.ReadString('\n')
+	if err != nil && line == "" {
+		return "", false
+	}
+	return strings.TrimRight(line, "\r\n"), true
+}
+
+// redirect – перенаправление вывода в файл (команда writeto)
+type redirect struct {
+	file *os.File
+	prev io.Writer
+}
+
+// redirectOutput – направляет последующий вывод в файл fileName (файл перезаписывается)
+func (in *Interpreter) redirectOutput(fileName string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	in.redirects = append(in.redirects, redirect{file: file, prev: in.Out})
+	in.Out = file
+	return nil
+}
+
+// restoreOutput – закрывает файл последнего перенаправления и возвращает прежний вывод
+func (in *Interpreter) restoreOutput() error {
+	if len(in.redirects) == 0 {
+		return errors.New("вывод не перенаправлен")
+	}
+	r := in.redirects[len(in.redirects)-1]
+	in.redirects = in.redirects[:len(in.redirects)-1]
+	in.Out = r.prev
+	return r.file.Close()
+}
+
+// closeRedirects – закрывает файлы, не закрытые командой "writeto;" (в конце работы)
+func (in *Interpreter) closeRedirects() {
+	for len(in.redirects) > 0 {
+		if err := in.restoreOutput(); err != nil {
+			in.reportError("ОШИБКА: writeto: %v", err)
+		}
+	}
+}
+
+// Snapshot – сохранённое состояние переменных и функций интерпретатора.
+// Содержимое недоступно снаружи: снимок можно только передать в Restore.
+type Snapshot struct {
+	variables map[string]*Variable
+	functions map[string]*Function
+}
+
+// copyState – глубокая копия карт переменных и функций: изменения
+// переменных (в том числе элементов массивов) и кэшей memoize после
+// копирования не видны в копии
+func copyState(variables map[string]*Variable, functions map[string]*Function) (map[string]*Variable, map[string]*Function) {
+	vars := make(map[string]*Variable, len(variables))
+	for name, v := range variables {
+		vars[name] = newVariable(v.get())
+	}
+	funcs := make(map[string]*Function, len(functions))
+	for name, fn := range functions {
+		cp := *fn
+		cp.params = append([]Param(nil), fn.params...)
+		if fn.memo != nil {
+			// кэш memoize заполняется при вызовах – у копии он свой
+			cp.memo = make(map[string][]Value, len(fn.memo))
+			for key, vals := range fn.memo {
+				cp.memo[key] = append([]Value(nil), vals...)
+			}
+		}
+		funcs[name] = &cp
+	}
+	return vars, funcs
+}
+
+// Snapshot – снимок текущих переменных и функций (например, для отмены в REPL)
+func (in *Interpreter) Snapshot() *Snapshot {
+	vars, funcs := copyState(in.variables, in.functions)
+	return &Snapshot{variables: vars, functions: funcs}
+}
+
+// Restore – возвращает переменные и функции к состоянию снимка.
+// Снимок не меняется и может быть восстановлен повторно.
+func (in *Interpreter) Restore(s *Snapshot) {
+	in.variables, in.functions = copyState(s.variables, s.functions)
+}
+
+// Reset – удаляет все переменные и функции
+func (in *Interpreter) Reset() {
+	in.variables = make(map[string]*Variable)
+	in.functions = make(map[string]*Function)
+}
+
+func (in *Interpreter) printStats() {
+	fmt.Fprintln(in.Out, "== Статистика операций ==")
+	fmt.Fprintln(in.Out, "сложений:", in.stats.additions)
+	fmt.Fprintln(in.Out, "вычитаний:", in.stats.subtractions)
+	fmt.Fprintln(in.Out, "умножений:", in.stats.multiplications)
+	fmt.Fprintln(in.Out, "делений:", in.stats.divisions)
+	fmt.Fprintln(in.Out, "возведений в степень:", in.stats.powers)
+	fmt.Fprintln(in.Out, "вызовов функций:", in.stats.calls)
+	fmt.Fprintf(in.Out, "разборов выражений: %d (из кэша: %d)\n", in.stats.parses, in.stats.cacheHits)
+	fmt.Fprintf(in.Out, "инструкций: %d (успешно: %d, с ошибками: %d)\n", in.stats.statements,
+		in.stats.statements-in.stats.failedStatements, in.stats.failedStatements)
+	names := make([]string, 0, len(in.stats.funcCalls))
+	for name := range in.stats.funcCalls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(in.Out, "  %s: %d\n", name, in.stats.funcCalls[name])
+	}
+}
+
+// printVariable – вывод переменной в формате "name = value (type)",
+// а в режиме --output json – объектом {"name":..., "type":..., "value":...}.
+// width – ширина поля значения (см. padValue).
+func (in *Interpreter) printVariable(name string, v *Variable, width int) {
+	val := v.get()
+	if in.jsonOutput {
+		in.writeJSON(jsonRecord{Name: name, Type: typeName(val), Value: jsonValue(val)})
+		return
+	}
+	in.printResult(fmt.Sprintf("%s = %s (%s)", name, padValue(in.printValue(val), width), typeName(val)))
+}
+
+// printValue – значение для вывода командами print, echo и show: как formatValue,
+// но вещественные с модулем от 1 до plainMax выводятся без экспоненты (1000000,
+// 1234567.5), в режиме --sci очень большие и очень малые вещественные (в том числе
+// элементы массивов) выводятся в экспоненциальной записи 1.5e+07 (целые не меняются),
+// а в режиме --sign положительные числа выводятся со знаком: +5
+func (in *Interpreter) printValue(v Value) string {
+	if v.kind == KindArray {
+		parts := make([]string, len(v.arr))
+		for i, el := range v.arr {
+			parts[i] = in.printValue(el)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	}
+	text := formatValue(v)
+	if v.kind != KindNumber {
+		return text
+	}
+	if !v.isInt {
+		// %g переходит к экспоненте уже с 1e+06; 'f' с точностью -1 даёт
+		// кратчайшую запись без лишних нулей
+		if abs := math.Abs(v.num); abs >= 1 && abs < in.plainMax {
+			text = strconv.FormatFloat(v.num, 'f', -1, 64)
+		}
+	}
+	if in.sci && !v.isInt {
+		abs := math.Abs(v.num)
+		if abs != 0 && !math.IsInf(abs, 0) && (abs >= in.sciThreshold || abs < 1/in.sciThreshold) {
+			// все значащие цифры, как в %g, но всегда с порядком
+			text = strconv.FormatFloat(v.num, 'e', -1, 64)
+		}
+	}
+	if in.showSign && v.num > 0 && !strings.HasPrefix(text, "+") {
+		// ноль и NaN выводятся без знака, +Inf уже со знаком
+		text = "+" + text
+	}
+	return text
+}
+
+// padValue – значение, выровненное по ширине поля width: положительная ширина
+// выравнивает по правому краю, отрицательная – по левому, 0 – без выравнивания.
+// Более длинное значение не обрезается.
+func padValue(s string, width int) string {
+	return fmt.Sprintf("%*s", width, s)
+}
+
+// jsonRecord – одно значение, выводимое командой print в режиме --output json.
+// Для переменной заполняется name, для выражения – expr.
+type jsonRecord struct {
+	Name  string      `json:"name,omitempty"`
+	Expr  string      `json:"expr,omitempty"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// jsonFunction – функция в выводе команды functions в режиме --output json;
+// порядок полей фиксирован порядком полей структуры
+type jsonFunction struct {
+	Name   string      `json:"name"`
+	Params []jsonParam `json:"params"`
+	Body   string      `json:"body"`
+}
+
+// jsonParam – параметр функции; type – объявленный тип ("int", "float") или отсутствует
+type jsonParam struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+// paramTypes – названия объявленных типов параметров
+var paramTypes = map[string]string{"i": "int", "f": "float"}
+
+// printFunctions – команда functions: все объявленные функции в порядке имён,
+// чтобы вывод был воспроизводимым; в режиме --output json – одним массивом
+func (in *Interpreter) printFunctions() {
+	names := make([]string, 0, len(in.functions))
+	for name := range in.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if in.jsonOutput {
+		records := make([]jsonFunction, len(names))
+		for i, name := range names {
+			fn := in.functions[name]
+			params := make([]jsonParam, len(fn.params))
+			for j, p := range fn.params {
+				params[j] = jsonParam{Name: p.name, Type: paramTypes[p.typ]}
+			}
+			records[i] = jsonFunction{Name: name, Params: params, Body: fn.expression}
+		}
+		in.writeJSON(records)
+		return
+	}
+	fmt.Fprintln(in.Out, "== Список всех функций ==")
+	for _, name := range names {
+		fn := in.functions[name]
+		params := make([]string, len(fn.params))
+		for i, p := range fn.params {
+			params[i] = p.name
+			if p.typ != "" {
+				params[i] += ":" + p.typ
+			}
+		}
+		fmt.Fprintf(in.Out, "%s(%s): %s\n", name, strings.Join(params, ", "), fn.expression)
+	}
+}
+
+// jsonValue – значение в виде, пригодном для encoding/json: целые – int64,
+// массивы – срезы; NaN и бесконечности (не представимые в JSON) – строки
+func jsonValue(v Value) interface{} {
+	switch {
+	case v.kind == KindArray:
+		elems := make([]interface{}, len(v.arr))
+		for i, el := range v.arr {
+			elems[i] = jsonValue(el)
+		}
+		return elems
+	case v.kind == KindString:
+		return v.str
+	case v.kind == KindFunction:
+		return formatValue(v)
+	case v.isInt:
+		return v.ival
+	case math.IsNaN(v.num) || math.IsInf(v.num, 0):
+		return formatValue(v)
+	default:
+		return v.num
+	}
+}
+
+// writeJSON – выводит x одной строкой JSON
+func (in *Interpreter) writeJSON(x interface{}) {
+	b, err := json.Marshal(x)
+	if err != nil {
+		in.reportError("ОШИБКА: не удалось сформировать JSON: %v", err)
+		return
+	}
+	fmt.Fprintln(in.Out, string(b))
+}
+
+// reportError – выводит сообщение об ошибке в поток ошибок и учитывает его в счётчике ошибок
+func (in *Interpreter) reportError(format string, args ...interface{}) {
+	in.errorCount++
+	msg := fmt.Sprintf(format, args...)
+	if in.color {
+		msg = colorRed + msg + colorReset
+	}
+	fmt.Fprintln(in.Err, msg)
+}
+
+// ANSI-последовательности для режима --color
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorReset = "\x1b[0m"
+)
+
+// printResult – выводит строку результата (print, echo, show); в режиме --color
+// она выделяется зелёным, кроме вывода, перенаправленного в файл командой writeto
+func (in *Interpreter) printResult(text string) {
+	if in.color && len(in.redirects) == 0 {
+		text = colorGreen + text + colorReset
+	}
+	fmt.Fprintln(in.Out, text)
+}
+
+// isTerminal – f открыт на терминал (а не на файл или канал)
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// warn – выводит предупреждение в поток ошибок; в отличие от reportError,
+// предупреждение не считается ошибкой и не влияет на код завершения
+func (in *Interpreter) warn(format string, args ...interface{}) {
+	fmt.Fprintf(in.Err, "ПРЕДУПРЕЖДЕНИЕ: "+format+"\n", args...)
+}
+
+// checkRuntime – прерывает выполнение, если превышено максимальное время работы:
+// паника timeoutError выходит из всех вложенных инструкций и вызовов функций
+// до runFile, repl или Eval, которые возвращают её как ошибку.
+// Проверяется перед каждой инструкцией и при каждом вызове функции.
+func (in *Interpreter) checkRuntime() {
+	if in.maxRuntime > 0 && time.Since(in.startTime) > in.maxRuntime {
+		panic(timeoutError{limit: in.maxRuntime})
+	}
+}
+
+// timeoutError – превышено максимальное время работы (флаг --max-runtime)
+type timeoutError struct {
+	limit time.Duration
+}
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("ОШИБКА: превышено максимальное время выполнения (%v), выполнение прервано", e.limit)
 }
 
-// Глобальные карты для хранения переменных и функций
-var variables = make(map[string]*Variable)
-var functions = make(map[string]*Function)
+// recoverTimeout – перехватывает выход по --max-runtime и записывает его в *err;
+// остальные паники не перехватываются
+func recoverTimeout(err *error) {
+	if r := recover(); r != nil {
+		te, ok := r.(timeoutError)
+		if !ok {
+			panic(r)
+		}
+		*err = te
+	}
+}
 
 // === Вспомогательные функции для хранения/поиска переменных и функций ===
 
-func setVariable(name string, isInt bool, val float64) {
+func (in *Interpreter) setVariable(name string, isInt bool, val Value) {
 	// Если переменная уже существует, используем уже заданный тип (при отсутствии явной инициализации)
-	if v, ok := variables[name]; ok {
-		// Приведение типа, если нужно
-		isInt = v.isInt
-		if isInt {
-			// Транкция (округление к 0) при записи в целую переменную
-			v.value = float64(int64(val))
-		} else {
-			v.value = val
+	if v, ok := in.variables[name]; ok {
+		// массив, строку или функцию числом не заменяем – как и при обычном присваивании
+		if v.kind != val.kind {
+			in.reportError("ОШИБКА: переменной \"%s\" (%s) нельзя присвоить значение типа %s",
+				name, typeName(v.get()), typeName(val))
+			return
+		}
+		if in.warnRedefine {
+			in.warn("переменная %s объявлена повторно (тип остаётся прежним)", name)
+		}
+		// Транкция (округление к 0) при записи в целую переменную
+		if !v.set(val) {
+			in.reportError("ОШИБКА: число слишком большое для целой переменной %s: %g", name, val.num)
 		}
 		return
 	}
 
 	// Если переменная новая
-	if isInt {
-		val = float64(int64(val)) // округляем для целочисленной
+	if !in.checkVariableLimit(name) {
+		return
+	}
+	v := &Variable{isInt: isInt}
+	if !v.set(val) {
+		in.reportError("ОШИБКА: число слишком большое для целой переменной %s: %g", name, val.num)
+		return
 	}
-	variables[name] = &Variable{isInt: isInt, value: val}
+	in.variables[name] = v
 }
 
-func getVariable(name string) (*Variable, bool) {
-	v, ok := variables[name]
+// checkVariableLimit – можно ли создать переменную name, не превысив --max-variables
+// (присваивание существующей переменной ограничение не затрагивает)
+func (in *Interpreter) checkVariableLimit(name string) bool {
+	if _, exists := in.variables[name]; exists || in.maxVariables <= 0 || len(in.variables) < in.maxVariables {
+		return true
+	}
+	in.reportError("ОШИБКА: нельзя создать переменную %s: достигнуто ограничение %d переменных (флаг --max-variables)",
+		name, in.maxVariables)
+	return false
+}
+
+// checkFunctionLimit – то же для функций: ограничение --max-variables действует
+// на число функций отдельно от числа переменных
+func (in *Interpreter) checkFunctionLimit(name string) bool {
+	if _, exists := in.functions[name]; exists || in.maxVariables <= 0 || len(in.functions) < in.maxVariables {
+		return true
+	}
+	in.reportError("ОШИБКА: нельзя создать функцию %s: достигнуто ограничение %d функций (флаг --max-variables)",
+		name, in.maxVariables)
+	return false
+}
+
+func (in *Interpreter) getVariable(name string) (*Variable, bool) {
+	v, ok := in.variables[name]
 	return v, ok
 }
 
-func setFunction(name string, params []string, expr string) {
-	functions[name] = &Function{
+func (in *Interpreter) setFunction(name string, params []Param, expr string) {
+	if !in.checkFunctionName(name) {
+		return
+	}
+	if _, exists := in.functions[name]; exists && in.warnRedefine {
+		in.warn("функция %s переопределена", name)
+	}
+	if !in.checkFunctionLimit(name) {
+		return
+	}
+	if in.checkFunctions {
+		in.checkFunctionBody(name, params, expr)
+	}
+	in.functions[name] = &Function{
+		name:       name,
 		params:     params,
 		expression: expr,
 	}
 }
 
-func getFunction(name string) (*Function, bool) {
-	f, ok := functions[name]
+// checkFunctionBody – флаг --check-functions: предупреждение о каждом имени в теле
+// функции, которое не является её параметром, самой функцией, объявленной или
+// встроенной функцией либо существующей переменной. Это может быть глобальная
+// переменная, объявленная позже, поэтому не ошибка, а предупреждение о возможной опечатке.
+func (in *Interpreter) checkFunctionBody(name string, params []Param, body string) {
+	root, err := in.parseExpr(body, true)
+	if err != nil {
+		return // ошибка разбора будет выведена при вызове функции
+	}
+	known := map[string]bool{name: true}
+	for _, p := range params {
+		known[p.name] = true
+	}
+	for _, id := range root.names(nil) {
+		_, isBuiltin := builtins[id]
+		_, isVar := in.variables[id]
+		_, isFunc := in.functions[id]
+		if known[id] || isBuiltin || isVar || isFunc {
+			continue
+		}
+		known[id] = true // по одному предупреждению на имя
+		in.warn("функция %s: имя \"%s\" не является параметром, функцией или переменной (опечатка?)", name, id)
+	}
+}
+
+// getFunction – функция name: лямбда в переменной name (в том числе в параметре
+// функции – так параметр заслоняет одноимённую объявленную функцию) или объявленная
+func (in *Interpreter) getFunction(name string) (*Function, bool) {
+	if v, ok := in.variables[name]; ok && v.kind == KindFunction {
+		return v.fn, true
+	}
+	f, ok := in.functions[name]
 	return f, ok
 }
 
+// variableOrigin – откуда берётся переменная name в текущей области видимости:
+// параметр самого внутреннего вызова, глобальная переменная или не объявлена (nil).
+func (in *Interpreter) variableOrigin(name string) (string, *Variable) {
+	v, ok := in.getVariable(name)
+	if !ok {
+		return "не объявлена", nil
+	}
+	if len(in.callStack) > 0 {
+		fn := in.callStack[len(in.callStack)-1]
+		for _, param := range fn.params {
+			if param.name == name {
+				return "параметр функции " + fn.name, v
+			}
+		}
+	}
+	return "глобальная переменная", v
+}
+
 // === Парсер выражений (упрощённый рекурсивный спуск) ===
 
 // Токенизация
@@ -73,13 +881,26 @@ type TokenType int
 const (
 	TokenNumber TokenType = iota
 	TokenIdent
+	TokenString // "текст" (value – текст без кавычек, с обработанными экранированиями)
 	TokenPlus
 	TokenMinus
 	TokenStar
 	TokenSlash
+	TokenFloorDiv // //
+	TokenPercent  // % (остаток с усечением)
+	TokenMod      // mod (остаток с округлением вниз)
+	TokenCaret    // ^
 	TokenLParen
 	TokenRParen
 	TokenComma
+	TokenLBracket  // [
+	TokenRBracket  // ]
+	TokenLess      // <
+	TokenLessEq    // <=
+	TokenGreater   // >
+	TokenGreaterEq // >=
+	TokenEq        // ==
+	TokenNotEq     // !=
 	TokenEOF
 	TokenError
 )
@@ -87,11 +908,18 @@ const (
 type Token struct {
 	typ   TokenType
 	value string
+	start int // позиция начала токена во входной строке (в рунах)
+	end   int // позиция сразу после конца токена: input[start:end] – текст токена
 }
 
 type Lexer struct {
 	input []rune
 	pos   int
+	depth int // глубина вложенности скобок ( и [ в текущей позиции
+
+	// Режим совместимости (флаг --eq-compat): одиночный '=' внутри скобок –
+	// сравнение на равенство, как "=="
+	singleEq bool
 }
 
 func NewLexer(s string) *Lexer {
@@ -119,7 +947,49 @@ func (l *Lexer) NextToken() Token {
 	for unicode.IsSpace(l.peekRune()) {
 		l.nextRune()
 	}
+	// Комментарий: всё после '#' до конца выражения. Строка инструкции очищается
+	// от комментария ещё в processLine, но тело функции и выражения, переданные
+	// в Eval, лексер видит как есть ('#' внутри строкового литерала – не комментарий)
+	if l.peekRune() == '#' {
+		l.pos = len(l.input)
+	}
+
+	start := l.pos
+	t := l.scanToken()
+	t.start = start
+	t.end = l.pos
+	return t
+}
+
+// scanString – строковый литерал в двойных кавычках; внутри допустимы
+// экранирования \", \\ и \n. Незакрытая строка – ошибочный токен.
+func (l *Lexer) scanString() Token {
+	l.nextRune() // пропускаем '"'
+	var b strings.Builder
+	for {
+		r := l.nextRune()
+		switch r {
+		case 0:
+			return Token{typ: TokenError, value: "незакрытая строка"}
+		case '"':
+			return Token{typ: TokenString, value: b.String()}
+		case '\\':
+			switch esc := l.nextRune(); esc {
+			case 'n':
+				b.WriteRune('\n')
+			case '"', '\\':
+				b.WriteRune(esc)
+			default:
+				return Token{typ: TokenError, value: "неизвестное экранирование \\" + string(esc)}
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
 
+// scanToken – читает очередной токен, начиная с текущей позиции (пробелы уже пропущены)
+func (l *Lexer) scanToken() Token {
 	r := l.peekRune()
 	if r == 0 {
 		return Token{typ: TokenEOF, value: ""}
@@ -138,30 +1008,86 @@ func (l *Lexer) NextToken() Token {
 		return Token{typ: TokenStar, value: "*"}
 	case '/':
 		l.nextRune()
+		if l.peekRune() == '/' {
+			l.nextRune()
+			return Token{typ: TokenFloorDiv, value: "//"}
+		}
 		return Token{typ: TokenSlash, value: "/"}
+	case '%':
+		l.nextRune()
+		return Token{typ: TokenPercent, value: "%"}
+	case '^':
+		l.nextRune()
+		return Token{typ: TokenCaret, value: "^"}
 	case '(':
 		l.nextRune()
+		l.depth++
 		return Token{typ: TokenLParen, value: "("}
 	case ')':
 		l.nextRune()
+		l.depth--
 		return Token{typ: TokenRParen, value: ")"}
 	case ',':
 		l.nextRune()
 		return Token{typ: TokenComma, value: ","}
-	}
+	case '"':
+		return l.scanString()
+	case '[':
+		l.nextRune()
+		l.depth++
+		return Token{typ: TokenLBracket, value: "["}
+	case ']':
+		l.nextRune()
+		l.depth--
+		return Token{typ: TokenRBracket, value: "]"}
+	case '<', '>', '=', '!':
+		// Операторы сравнения: <, <=, >, >=, ==, !=
+		l.nextRune()
+		if l.peekRune() == '=' {
+			l.nextRune()
+			switch r {
+			case '<':
+				return Token{typ: TokenLessEq, value: "<="}
+			case '>':
+				return Token{typ: TokenGreaterEq, value: ">="}
+			case '=':
+				return Token{typ: TokenEq, value: "=="}
+			default:
+				return Token{typ: TokenNotEq, value: "!="}
+			}
+		}
+		switch r {
+		case '<':
+			return Token{typ: TokenLess, value: "<"}
+		case '>':
+			return Token{typ: TokenGreater, value: ">"}
+		}
+		if r == '=' && l.singleEq && l.depth > 0 {
+			return Token{typ: TokenEq, value: "="}
+		}
+		// одиночные '=' и '!' в выражениях не допускаются
+		return Token{typ: TokenError, value: string(r)}
+	}
 
-	// Числа (упрощённо)
+	// Числа (упрощённо). Цифры, точки и подчёркивания читаются подряд целиком,
+	// поэтому "1.2.3" или "1..2" дают один неверный литерал, а не несколько чисел.
 	if unicode.IsDigit(r) {
 		startPos := l.pos
-		dotCount := 0
-		for unicode.IsDigit(l.peekRune()) || l.peekRune() == '.' {
-			if l.peekRune() == '.' {
-				dotCount++
-				if dotCount > 1 {
-					break
+		for unicode.IsDigit(l.peekRune()) || l.peekRune() == '.' || l.peekRune() == '_' {
+			l.nextRune()
+		}
+		// экспонента: 1e-9, 2.5E+3 (только если за 'e' действительно следуют цифры)
+		if r := l.peekRune(); r == 'e' || r == 'E' {
+			i := l.pos + 1
+			if i < len(l.input) && (l.input[i] == '+' || l.input[i] == '-') {
+				i++
+			}
+			if i < len(l.input) && unicode.IsDigit(l.input[i]) {
+				l.pos = i
+				for unicode.IsDigit(l.peekRune()) {
+					l.nextRune()
 				}
 			}
-			l.nextRune()
 		}
 		numStr := string(l.input[startPos:l.pos])
 		return Token{typ: TokenNumber, value: numStr}
@@ -174,6 +1100,10 @@ func (l *Lexer) NextToken() Token {
 			l.nextRune()
 		}
 		ident := string(l.input[startPos:l.pos])
+		if ident == "mod" {
+			// "a mod b" – операция, а не имя
+			return Token{typ: TokenMod, value: ident}
+		}
 		return Token{typ: TokenIdent, value: ident}
 	}
 
@@ -182,361 +1112,3740 @@ func (l *Lexer) NextToken() Token {
 }
 
 // Рекурсивный спуск:
-// expr = term { ("+" | "-") term }
-// term = factor { ("*" | "/") factor }
-// factor = number | ident [ "(" exprlist ")" ] | "(" expr ")"
+// expr = sum { relop sum }          (цепочка сравнений: a < b < c означает a < b и b < c)
+// relop = "<" | "<=" | ">" | ">=" | "==" | "!="
+// sum = term { ("+" | "-") term }
+// term = power { ("*" | "/" | "//" | "%" | "mod") power }
+// power = factor [ "^" power ]      (правоассоциативно: 2^3^2 = 2^(3^2))
+// factor = number | ident [ "(" exprlist ")" | "[" expr "]" ] | "(" expr ")" | "[" [ exprlist ] "]"
 // exprlist = expr { "," expr }
+//
+// Выражение сначала целиком разбирается в дерево (Node), затем дерево
+// вычисляется (evaluator). Разбор не зависит от значений переменных, поэтому
+// дерево можно вывести, ничего не вычисляя (флаг --ast).
+
+// NodeKind – вид узла дерева разбора
+type NodeKind int
+
+const (
+	NodeNumber  NodeKind = iota // числовой литерал
+	NodeString                  // строковый литерал
+	NodeVar                     // переменная
+	NodeNeg                     // унарный минус
+	NodeBinary                  // арифметическая операция op над args[0] и args[1]
+	NodeCompare                 // цепочка сравнений: args[0] ops[0] args[1] ops[1] args[2] ...
+	NodeCall                    // вызов функции name(args...)
+	NodeIndex                   // элемент массива name[args[0]]
+	NodeArray                   // литерал массива [args...]
+	NodeDefined                 // defined(name)
+	NodeMap                     // map(name, args[0])
+	NodeApply                   // вызов значения-функции args[0](args[1:]...), например fs[0](3)
+	NodeTuple                   // кортеж (args...) – только как всё выражение целиком
+)
+
+// Node – узел дерева разбора выражения
+type Node struct {
+	kind NodeKind
+	op   TokenType   // оператор (NodeBinary)
+	ops  []TokenType // операторы сравнения (NodeCompare)
+	val  Value       // значение литерала (NodeNumber, NodeString)
+	name string      // имя переменной или функции; для числа – текст литерала
+	args []*Node     // операнды, аргументы вызова или элементы массива
+
+	// Место узла в исходной строке (в рунах): ошибка вычисления
+	// подчёркивает подвыражение целиком
+	start, end int
+}
 
 type Parser struct {
-	lexer  *Lexer
-	curr   Token
-	errMsg string
+	in      *Interpreter // интерпретатор, в контексте которого разбирается выражение (--eq-compat)
+	lexer   *Lexer
+	curr    Token
+	prevEnd int // конец последнего разобранного токена
+	errMsg  string
+	errPos  int // позиция токена, на котором обнаружена ошибка
+	errEnd  int // конец этого токена
 }
 
-func NewParser(input string) *Parser {
-	p := &Parser{lexer: NewLexer(input)}
+func NewParser(in *Interpreter, input string) *Parser {
+	p := &Parser{in: in, lexer: NewLexer(input)}
+	p.lexer.singleEq = in.eqCompat
 	p.next()
 	return p
 }
 
 func (p *Parser) next() {
+	p.prevEnd = p.curr.end
 	p.curr = p.lexer.NextToken()
 }
 
 func (p *Parser) error(msg string) {
 	p.errMsg = msg
+	p.errPos = p.curr.start
+	p.errEnd = p.curr.end
+}
+
+// expectEnd – после разобранного выражения не должно остаться лишних токенов:
+// "a = b = c" или "1 2" – ошибка, а не молча отброшенный хвост
+func (p *Parser) expectEnd() {
+	if p.errMsg == "" && p.curr.typ != TokenEOF {
+		p.error("Неожиданный токен: " + p.text(p.curr))
+	}
+}
+
+// text – исходный текст токена (точная подстрока выражения)
+func (p *Parser) text(t Token) string {
+	if t.end <= t.start {
+		return t.value // нераспознанный символ: лексер его не прочитал
+	}
+	return string(p.lexer.input[t.start:t.end])
+}
+
+// span – задаёт узлу n место в исходной строке: от start до конца
+// последнего разобранного токена
+func (p *Parser) span(n *Node, start int) *Node {
+	n.start, n.end = start, p.prevEnd
+	return n
+}
+
+// errorContext – исходное выражение и строка с указателем '^' под местом
+// ошибки [pos, end) (как в сообщениях компиляторов); указатель подчёркивает
+// токен или подвыражение целиком
+func errorContext(input string, pos, end int) string {
+	width := end - pos
+	if width < 1 {
+		width = 1
+	}
+	return "    " + input + "\n    " + strings.Repeat(" ", pos) + strings.Repeat("^", width)
+}
+
+// parseExpression – уровень сравнений. Цепочка a < b < c вычисляется как в Python:
+// (a < b) и (b < c), причём средний операнд вычисляется один раз (см. evaluator.compare).
+func (p *Parser) parseExpression() *Node {
+	start := p.curr.start
+	left := p.parseSum()
+	if !isComparison(p.curr.typ) {
+		return left
+	}
+	n := &Node{kind: NodeCompare, args: []*Node{left}}
+	for isComparison(p.curr.typ) {
+		n.ops = append(n.ops, p.curr.typ)
+		p.next()
+		n.args = append(n.args, p.parseSum())
+	}
+	return p.span(n, start)
+}
+
+func isComparison(t TokenType) bool {
+	switch t {
+	case TokenLess, TokenLessEq, TokenGreater, TokenGreaterEq, TokenEq, TokenNotEq:
+		return true
+	}
+	return false
+}
+
+// compare – применяет оператор сравнения op к a и b (целые сравниваются точно).
+// Сравнения с NaN следуют IEEE 754: все ложны, кроме "!=" (NaN != NaN – истина).
+func compare[T int64 | float64](op TokenType, a, b T) bool {
+	switch op {
+	case TokenLess:
+		return a < b
+	case TokenLessEq:
+		return a <= b
+	case TokenGreater:
+		return a > b
+	case TokenGreaterEq:
+		return a >= b
+	case TokenEq:
+		return a == b
+	default:
+		return a != b
+	}
+}
+
+// boolValue – логическое значение в виде целого 1 или 0
+func boolValue(b bool) Value {
+	if b {
+		return intValue(1)
+	}
+	return intValue(0)
+}
+
+// arith – результат арифметической операции: для двух целых – точная
+// целочисленная операция op, если она определена и не переполняет int64;
+// иначе – вещественный результат f
+func arith(a, b Value, op func(x, y int64) (int64, bool), f float64) Value {
+	if a.isInt && b.isInt {
+		if res, ok := op(a.ival, b.ival); ok {
+			return intValue(res)
+		}
+	}
+	return Value{num: f}
+}
+
+func addInt64(x, y int64) (int64, bool) {
+	res := x + y
+	return res, (res > x) == (y > 0)
+}
+
+func subInt64(x, y int64) (int64, bool) {
+	res := x - y
+	return res, (res < x) == (y > 0)
+}
+
+func mulInt64(x, y int64) (int64, bool) {
+	if x == 0 || y == 0 {
+		return 0, true
+	}
+	res := x * y
+	if res/y != x || (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64) {
+		return 0, false
+	}
+	return res, true
+}
+
+// powInt64 – x в степени y (y >= 0) возведением в квадрат, без переполнения
+func powInt64(x, y int64) (int64, bool) {
+	if y < 0 {
+		return 0, false
+	}
+	res, ok := int64(1), true
+	for y > 0 {
+		if y&1 == 1 {
+			if res, ok = mulInt64(res, x); !ok {
+				return 0, false
+			}
+		}
+		y >>= 1
+		if y > 0 {
+			if x, ok = mulInt64(x, x); !ok {
+				return 0, false
+			}
+		}
+	}
+	return res, true
+}
+
+// divInt64 – частное, только если x делится на y нацело
+func divInt64(x, y int64) (int64, bool) {
+	if y == 0 || x%y != 0 || (x == math.MinInt64 && y == -1) {
+		return 0, false
+	}
+	return x / y, true
+}
+
+// floorDivInt64 – частное с округлением вниз: -7 // 2 = -4
+func floorDivInt64(x, y int64) (int64, bool) {
+	if y == 0 || (x == math.MinInt64 && y == -1) {
+		return 0, false
+	}
+	q := x / y
+	if x%y != 0 && (x < 0) != (y < 0) {
+		q--
+	}
+	return q, true
 }
 
-func (p *Parser) parseExpression() float64 {
-	val := p.parseTerm()
+func (p *Parser) parseSum() *Node {
+	start := p.curr.start
+	n := p.parseTerm()
 	for p.curr.typ == TokenPlus || p.curr.typ == TokenMinus {
 		op := p.curr.typ
 		p.next()
 		right := p.parseTerm()
-		if op == TokenPlus {
-			val += right
-		} else {
-			val -= right
-		}
+		n = p.span(&Node{kind: NodeBinary, op: op, args: []*Node{n, right}}, start)
 	}
-	return val
+	return n
 }
 
-func (p *Parser) parseTerm() float64 {
-	val := p.parseFactor()
-	for p.curr.typ == TokenStar || p.curr.typ == TokenSlash {
+func (p *Parser) parseTerm() *Node {
+	start := p.curr.start
+	n := p.parsePower()
+	for p.curr.typ == TokenStar || p.curr.typ == TokenSlash || p.curr.typ == TokenFloorDiv ||
+		p.curr.typ == TokenPercent || p.curr.typ == TokenMod {
 		op := p.curr.typ
 		p.next()
-		right := p.parseFactor()
-		if op == TokenStar {
-			val *= right
-		} else {
-			// деление
-			if right == 0 {
-				// В реальном интерпретаторе нужно как-то обрабатывать деление на ноль.
-				// Здесь просто разделим на 0.0, что даст +Inf/-Inf.
-				val = val / 0.0
-			} else {
-				val /= right
-			}
-		}
+		right := p.parsePower()
+		n = p.span(&Node{kind: NodeBinary, op: op, args: []*Node{n, right}}, start)
+	}
+	return n
+}
+
+// parsePower – возведение в степень (правоассоциативно)
+func (p *Parser) parsePower() *Node {
+	start := p.curr.start
+	base := p.parseFactor()
+	if p.curr.typ != TokenCaret {
+		return base
 	}
-	return val
+	p.next()
+	exp := p.parsePower()
+	return p.span(&Node{kind: NodeBinary, op: TokenCaret, args: []*Node{base, exp}}, start)
 }
 
-func (p *Parser) parseFactor() float64 {
+func (p *Parser) parseFactor() *Node {
+	start := p.curr.start
 	switch p.curr.typ {
 	case TokenNumber:
-		// конвертируем в float64
-		f, err := strconv.ParseFloat(p.curr.value, 64)
-		if err != nil {
-			p.error("Невозможно преобразовать число: " + p.curr.value)
-			return 0
+		lit := p.curr.value
+		if strings.Count(lit, ".") > 1 || !validUnderscores(lit) {
+			p.error("Неверный числовой литерал: " + lit)
+			return nil
+		}
+		text := strings.ReplaceAll(lit, "_", "")
+		// Литерал без дробной точки и экспоненты – целый, если помещается в int64: он
+		// разбирается как целое без потери точности (2^53 + 1 не округляется);
+		// слишком большие целые литералы считаются вещественными
+		var val Value
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil && !strings.Contains(text, ".") {
+			val = intValue(i)
+		} else {
+			f, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				p.error("Невозможно преобразовать число: " + lit)
+				return nil
+			}
+			val = Value{num: f}
 		}
 		p.next()
-		return f
+		return p.span(&Node{kind: NodeNumber, val: val, name: lit}, start)
+	case TokenString:
+		n := &Node{kind: NodeString, val: Value{kind: KindString, str: p.curr.value}}
+		p.next()
+		return p.span(n, start)
+	case TokenMinus:
+		// унарный минус связывает слабее степени: -2^2 = -(2^2)
+		p.next()
+		operand := p.parsePower()
+		return p.span(&Node{kind: NodeNeg, args: []*Node{operand}}, start)
 	case TokenIdent:
 		// Может быть переменная, может быть вызов функции
 		identName := p.curr.value
 		p.next()
 		if p.curr.typ == TokenLParen {
-			// вызов функции
-			// Считываем аргументы
-			p.next() // пропускаем '('
-			args := []float64{}
-			if p.curr.typ != TokenRParen {
-				for {
-					argVal := p.parseExpression()
-					args = append(args, argVal)
-					if p.curr.typ == TokenComma {
-						p.next()
-						continue
-					}
-					break
-				}
-			}
-			if p.curr.typ != TokenRParen {
-				p.error("Ожидалась закрывающая скобка в вызове функции")
-				return 0
-			}
-			p.next() // пропускаем ')'
-
-			// Ищем функцию
-			fn, ok := getFunction(identName)
-			if !ok {
-				// Ошибка: функция не найдена
-				fmt.Printf("ОШИБКА: использование не объявленной функции \"%s\"\n", identName)
-				return 0
+			// проверка существования имени: defined(x)
+			if identName == "defined" {
+				return p.parseDefined(start)
 			}
-
-			// Проверка числа параметров
-			if len(fn.params) != len(args) {
-				p.error(fmt.Sprintf("Функция %s ожидала %d аргументов, передано %d",
-					identName, len(fn.params), len(args)))
-				return 0
+			// применение функции к элементам массива: map(f, a)
+			if identName == "map" {
+				return p.parseMap(start)
 			}
-
-			// Вычисляем путём временного создания окружения
-			return evaluateFunction(fn, args)
-		} else {
-			// переменная
-			v, ok := getVariable(identName)
-			if !ok {
-				// Ошибка: переменная не найдена
-				fmt.Printf("ОШИБКА: использование не объявленной переменной \"%s\"\n", identName)
-				return 0
+			// вызов функции
+			args := p.parseArgs()
+			return p.span(&Node{kind: NodeCall, name: identName, args: args}, start)
+		}
+		// элемент массива: a[i]; если элемент – функция, его можно вызвать: fs[0](3)
+		if p.curr.typ == TokenLBracket {
+			n := p.parseIndex(identName, start)
+			for p.curr.typ == TokenLParen {
+				args := p.parseArgs()
+				n = p.span(&Node{kind: NodeApply, args: append([]*Node{n}, args...)}, start)
 			}
-			return v.value
+			return n
 		}
+		// переменная
+		return p.span(&Node{kind: NodeVar, name: identName}, start)
 	case TokenLParen:
 		p.next()
-		val := p.parseExpression()
+		n := p.parseExpression()
 		if p.curr.typ != TokenRParen {
 			p.error("Ожидалась закрывающая скобка )")
-			return val
+			return n
 		}
 		p.next()
-		return val
+		return n
+	case TokenLBracket:
+		return p.parseArrayLiteral()
 	default:
-		p.error("Неожиданный токен: " + p.curr.value)
-		return 0
+		p.error("Неожиданный токен: " + p.text(p.curr))
+		return nil
 	}
 }
 
-// evaluateFunction – вычисляет тело функции, подставляя аргументы в параметры.
-// Для простоты делаем: во время вычисления выражения функции создаём «временные» переменные с именами параметров
-// и после вычисления восстанавливаем старые значения (или отсутствие таковых).
-func evaluateFunction(fn *Function, args []float64) float64 {
-	// Сохраним текущее состояние переменных, которые совпадают с именами параметров.
-	backup := make(map[string]*Variable)
-	// Для каждого параметра создаём/перезаписываем переменную
-	for i, paramName := range fn.params {
-		if orig, found := getVariable(paramName); found {
-			backup[paramName] = &Variable{isInt: orig.isInt, value: orig.value}
+// validUnderscores – подчёркивания в числовом литерале (1_000_000) допустимы
+// только между двумя цифрами: "1_", "1__0" и "1_.0" – неверные литералы
+func validUnderscores(lit string) bool {
+	for i := 0; i < len(lit); i++ {
+		if lit[i] != '_' {
+			continue
+		}
+		if i == 0 || i == len(lit)-1 || !unicode.IsDigit(rune(lit[i-1])) || !unicode.IsDigit(rune(lit[i+1])) {
+			return false
 		}
-		// При подстановке аргументов типа не знаем, пусть будет float, если дробь – значит float.
-		isInteger := float64(int64(args[i])) == args[i]
-		setVariable(paramName, isInteger, args[i])
 	}
+	return true
+}
 
-	// Вычислим выражение
-	p := NewParser(fn.expression)
-	val := p.parseExpression()
-	if p.errMsg != "" {
-		fmt.Println("ОШИБКА при вычислении функции:", p.errMsg)
+// parseArrayLiteral – литерал массива "[e1, e2, ...]" (текущий токен – '[')
+func (p *Parser) parseArrayLiteral() *Node {
+	start := p.curr.start
+	p.next() // пропускаем '['
+	n := &Node{kind: NodeArray}
+	if p.curr.typ != TokenRBracket {
+		for {
+			n.args = append(n.args, p.parseExpression())
+			if p.curr.typ == TokenComma {
+				p.next()
+				continue
+			}
+			break
+		}
+	}
+	if p.curr.typ != TokenRBracket {
+		p.error("Ожидалась закрывающая скобка ]")
+		return nil
 	}
+	p.next() // пропускаем ']'
+	return p.span(n, start)
+}
 
-	// Восстановим старые значения переменных
-	for _, paramName := range fn.params {
-		// Удаляем временную переменную (или восстанавливаем из backup)
-		delete(variables, paramName)
-		if bkp, ok := backup[paramName]; ok {
-			// восстановить
-			variables[paramName] = bkp
-		}
+// parseIndex – обращение к элементу массива name[i] (текущий токен – '[')
+func (p *Parser) parseIndex(name string, start int) *Node {
+	p.next() // пропускаем '['
+	idx := p.parseExpression()
+	if p.curr.typ != TokenRBracket {
+		p.error("Ожидалась закрывающая скобка ]")
+		return nil
 	}
+	p.next() // пропускаем ']'
+	return p.span(&Node{kind: NodeIndex, name: name, args: []*Node{idx}}, start)
+}
 
-	return val
+// parseArgs – разбирает список аргументов вызова (текущий токен – '(')
+// вместе с закрывающей скобкой.
+func (p *Parser) parseArgs() []*Node {
+	p.next() // пропускаем '('
+	args := []*Node{}
+	if p.curr.typ != TokenRParen {
+		for {
+			// пустое место для аргумента: f(,1), f(1,,2) или f(1,)
+			if p.curr.typ == TokenComma || p.curr.typ == TokenRParen {
+				p.error(fmt.Sprintf("Пропущен аргумент %d в вызове функции", len(args)+1))
+				return nil
+			}
+			args = append(args, p.parseExpression())
+			if p.curr.typ == TokenComma {
+				p.next()
+				continue
+			}
+			break
+		}
+	}
+	if p.curr.typ != TokenRParen {
+		p.error("Ожидалась закрывающая скобка в вызове функции")
+		return nil
+	}
+	p.next() // пропускаем ')'
+	return args
 }
 
-// evaluateExpression – вспомогательная функция для вычисления произвольной строки-выражения
-func evaluateExpression(expr string) (float64, bool) {
-	p := NewParser(expr)
-	val := p.parseExpression()
-	if p.errMsg != "" {
-		fmt.Println("ОШИБКА при вычислении выражения:", p.errMsg)
-		return 0, false
+// parseDefined – встроенная функция defined(name). Аргумент – имя, а не выражение:
+// он не вычисляется, поэтому неизвестное имя не считается ошибкой.
+func (p *Parser) parseDefined(start int) *Node {
+	p.next() // пропускаем '('
+	if p.curr.typ != TokenIdent {
+		p.error("Функция defined ожидала имя переменной или функции")
+		return nil
 	}
-	return val, true
+	name := p.curr.value
+	p.next()
+	if p.curr.typ != TokenRParen {
+		p.error("Ожидалась закрывающая скобка в вызове функции")
+		return nil
+	}
+	p.next() // пропускаем ')'
+	return p.span(&Node{kind: NodeDefined, name: name}, start)
 }
 
-// === Разбор инструкций ===
+// parseMap – встроенная функция map(f, a). Первый аргумент – имя функции
+// (не вычисляется), второй – выражение-массив.
+func (p *Parser) parseMap(start int) *Node {
+	p.next() // пропускаем '('
+	if p.curr.typ != TokenIdent {
+		p.error("Функция map ожидала имя функции первым аргументом")
+		return nil
+	}
+	fnName := p.curr.value
+	p.next()
+	if p.curr.typ != TokenComma {
+		p.error("Функция map ожидала 2 аргумента: имя функции и массив")
+		return nil
+	}
+	p.next() // пропускаем ','
+	arr := p.parseExpression()
+	if p.curr.typ != TokenRParen {
+		p.error("Ожидалась закрывающая скобка в вызове функции")
+		return nil
+	}
+	p.next() // пропускаем ')'
+	return p.span(&Node{kind: NodeMap, name: fnName, args: []*Node{arr}}, start)
+}
 
-func processLine(line string) {
-	line = strings.TrimSpace(line)
-	if line == "" {
-		return
+// parseResults – разбирает выражение, которое может дать несколько значений:
+// кортеж "(e1, e2, ...)" или вызов функции, возвращающей кортеж (вызов в корне
+// дерева, см. evaluator.results). Любое другое выражение даёт ровно одно значение.
+func (p *Parser) parseResults() *Node {
+	if !isTuple(tokenize(string(p.lexer.input))) {
+		return p.parseExpression()
 	}
-	// Убираем trailing ';' (по условию – каждая инструкция заканчивается точкой с запятой)
-	if strings.HasSuffix(line, ";") {
-		line = line[:len(line)-1]
+	start := p.curr.start
+	p.next() // пропускаем '('
+	n := &Node{kind: NodeTuple}
+	for {
+		n.args = append(n.args, p.parseExpression())
+		if p.curr.typ == TokenComma {
+			p.next()
+			continue
+		}
+		break
 	}
-	line = strings.TrimSpace(line)
+	p.next() // пропускаем ')' (наличие проверено в isTuple)
+	return p.span(n, start)
+}
 
-	// 1) Проверим, не print ли это
-	//    - "print;" или "print varName;"
-	if strings.HasPrefix(line, "print") {
-		rest := strings.TrimSpace(line[len("print"):])
-		if rest == "" {
-			// вывести все переменные
-			fmt.Println("== Список всех переменных ==")
-			for name, v := range variables {
-				if v.isInt {
-					fmt.Printf("%s = %d (int)\n", name, int64(v.value))
-				} else {
-					fmt.Printf("%s = %g (float)\n", name, v.value)
-				}
-			}
-		} else {
-			// print varName
-			rest = strings.TrimSpace(rest)
-			if rest[0] == '=' {
-				// теоретически такого не должно быть, но на всякий случай
-				rest = rest[1:]
-				rest = strings.TrimSpace(rest)
-			}
-			varName := rest
-			if v, ok := getVariable(varName); ok {
-				if v.isInt {
-					fmt.Printf("%s = %d (int)\n", varName, int64(v.value))
-				} else {
-					fmt.Printf("%s = %g (float)\n", varName, v.value)
-				}
-			} else {
-				fmt.Printf("ОШИБКА: переменная \"%s\" не объявлена\n", varName)
-			}
+// tokenize – разбивает строку на токены целиком (без EOF);
+// используется для предварительного анализа структуры выражения без его вычисления.
+func tokenize(s string) []Token {
+	l := NewLexer(s)
+	var toks []Token
+	for {
+		t := l.NextToken()
+		if t.typ == TokenEOF {
+			return toks
+		}
+		toks = append(toks, t)
+		if t.typ == TokenError {
+			return toks // дальше разбирать нечего: лексер не продвинулся
 		}
-		return
 	}
+}
 
-	// 2) Проверим, не функция ли это:  name(arg1, arg2, ...): выражение
-	//    Признак – наличие двоеточия ':' после списка параметров
-	if strings.Contains(line, ":") {
-		// Пример: foo(x, y): (x*y+2)...
-		parts := strings.SplitN(line, ":", 2)
-		left := strings.TrimSpace(parts[0])  // foo(x, y)
-		right := strings.TrimSpace(parts[1]) // (x*y+2)...
-
-		// Разберём left, чтобы извлечь имя функции и параметры
-		// Формат:  functionName(param1, param2, ...)
-		idxOpenParen := strings.Index(left, "(")
-		idxCloseParen := strings.Index(left, ")")
-		if idxOpenParen == -1 || idxCloseParen == -1 || idxCloseParen < idxOpenParen {
-			fmt.Println("ОШИБКА: неверный формат определения функции:", line)
-			return
+// closingParen – индекс скобки, закрывающей открывающую скобку toks[open], или -1
+func closingParen(toks []Token, open int) int {
+	depth := 0
+	for i := open; i < len(toks); i++ {
+		switch toks[i].typ {
+		case TokenLParen:
+			depth++
+		case TokenRParen:
+			depth--
+			if depth == 0 {
+				return i
+			}
 		}
-		funcName := strings.TrimSpace(left[:idxOpenParen])
-		paramsStr := left[idxOpenParen+1 : idxCloseParen]
-		paramsStr = strings.TrimSpace(paramsStr)
-		var paramNames []string
-		if paramsStr != "" {
-			arr := strings.Split(paramsStr, ",")
-			for _, p := range arr {
-				paramNames = append(paramNames, strings.TrimSpace(p))
+	}
+	return -1
+}
+
+// isTuple – выражение целиком является кортежем "(e1, e2, ...)" с запятой на верхнем уровне скобок
+func isTuple(toks []Token) bool {
+	if len(toks) == 0 || toks[0].typ != TokenLParen || closingParen(toks, 0) != len(toks)-1 {
+		return false
+	}
+	depth := 0
+	for _, t := range toks {
+		switch t.typ {
+		case TokenLParen:
+			depth++
+		case TokenRParen:
+			depth--
+		case TokenComma:
+			if depth == 1 {
+				return true
 			}
 		}
+	}
+	return false
+}
 
-		// Сохраняем функцию в карту
-		setFunction(funcName, paramNames, right)
-		return
+// names – имена переменных и функций, на которые ссылается дерево, в порядке
+// появления; аргумент defined(x) не вычисляется и не считается ссылкой
+func (n *Node) names(out []string) []string {
+	switch n.kind {
+	case NodeVar, NodeCall, NodeIndex, NodeMap:
+		out = append(out, n.name)
+	}
+	for _, a := range n.args {
+		out = a.names(out)
 	}
+	return out
+}
 
-	// 3) Проверим, не инициализация ли переменной с типом:  varName(i)=...  или varName(f)=...
-	//    Ищем шаблон:  что-то(...)=<что-то>
-	if strings.Contains(line, ")=") {
-		// Пример: myvar(i)=15
-		parts := strings.SplitN(line, ")=", 2)
-		left := parts[0] // myvar(i
-		right := strings.TrimSpace(parts[1])
-		idxOpenParen := strings.Index(left, "(")
-		if idxOpenParen == -1 {
-			fmt.Println("ОШИБКА: неверный формат при инициализации переменной:", line)
-			return
-		}
-		varName := strings.TrimSpace(left[:idxOpenParen])
-		typeChar := strings.TrimSpace(left[idxOpenParen+1:]) // i или f
+// opNames – запись операторов в S-выражениях
+var opNames = map[TokenType]string{
+	TokenPlus: "+", TokenMinus: "-", TokenStar: "*", TokenSlash: "/", TokenFloorDiv: "//", TokenCaret: "^",
+	TokenPercent: "%", TokenMod: "mod",
+	TokenLess: "<", TokenLessEq: "<=", TokenGreater: ">", TokenGreaterEq: ">=", TokenEq: "==", TokenNotEq: "!=",
+}
 
-		// Вычислим выражение
-		val, ok := evaluateExpression(right)
-		if !ok {
-			return
+// String – дерево в виде S-выражения (флаг --ast): "2 + 3 * 4" -> (+ 2 (* 3 4)),
+// "-x" -> (- x), "f(a, 1)" -> (f a 1), "a[i]" -> (index a i), "[1, 2]" -> (array 1 2),
+// "fs[0](3)" -> (apply (index fs 0) 3);
+// цепочка сравнений "a < b <= c" -> (and (< a b) (<= b c))
+func (n *Node) String() string {
+	switch n.kind {
+	case NodeNumber, NodeVar:
+		return n.name
+	case NodeString:
+		return strconv.Quote(n.val.str)
+	case NodeNeg:
+		return sexpr("-", n.args)
+	case NodeBinary:
+		return sexpr(opNames[n.op], n.args)
+	case NodeCompare:
+		parts := make([]string, len(n.ops))
+		for i, op := range n.ops {
+			parts[i] = sexpr(opNames[op], n.args[i:i+2])
 		}
-		if typeChar == "i" {
-			setVariable(varName, true, val)
-		} else if typeChar == "f" {
-			setVariable(varName, false, val)
-		} else {
-			fmt.Println("ОШИБКА: неизвестный тип переменной:", typeChar)
+		if len(parts) == 1 {
+			return parts[0]
 		}
+		return "(and " + strings.Join(parts, " ") + ")"
+	case NodeCall:
+		return sexpr(n.name, n.args)
+	case NodeIndex:
+		return sexpr("index "+n.name, n.args)
+	case NodeArray:
+		return sexpr("array", n.args)
+	case NodeDefined:
+		return "(defined " + n.name + ")"
+	case NodeMap:
+		return sexpr("map "+n.name, n.args)
+	case NodeApply:
+		return sexpr("apply", n.args)
+	default:
+		return sexpr("tuple", n.args)
+	}
+}
+
+// sexpr – S-выражение "(head arg1 arg2 ...)"
+func sexpr(head string, args []*Node) string {
+	var b strings.Builder
+	b.WriteString("(" + head)
+	for _, a := range args {
+		b.WriteString(" " + a.String())
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// evaluator – вычисляет дерево разбора в текущем состоянии интерпретатора.
+// Запоминается первая ошибка и узел, на котором она обнаружена; после ошибки
+// оставшиеся узлы не вычисляются.
+type evaluator struct {
+	in     *Interpreter
+	errMsg string
+	errPos int // начало узла, на котором обнаружена ошибка
+	errEnd int // конец этого узла
+
+	// Об ошибке уже сообщено (не объявленное имя, ошибка в теле вызванной функции):
+	// вычисление прерывается, но сообщение не выводится повторно
+	reported bool
+}
+
+func (e *evaluator) error(n *Node, msg string) {
+	if e.errMsg == "" {
+		e.errMsg, e.errPos, e.errEnd = msg, n.start, n.end
+	}
+}
+
+// undefined – обращение к не объявленной переменной или функции (what – "переменной"
+// или "функции"): сообщение выводится сразу, и вычисление прерывается
+func (e *evaluator) undefined(n *Node, what, name string) {
+	if e.errMsg != "" {
 		return
 	}
+	msg := fmt.Sprintf("использование не объявленной %s \"%s\"", what, name)
+	e.in.reportError("ОШИБКА: %s", msg)
+	e.error(n, msg)
+	e.reported = true
+}
 
-	// 4) Иначе, это либо обычное присваивание вида varName=expr,
-	//    либо что-то некорректное.
-	if strings.Contains(line, "=") {
-		parts := strings.SplitN(line, "=", 2)
-		varName := strings.TrimSpace(parts[0])
-		expr := strings.TrimSpace(parts[1])
+// invoke – вызов пользовательской функции из выражения; ошибка в её теле
+// (уже выведенная) прерывает и вычисление вызывающего выражения
+func (e *evaluator) invoke(n *Node, fn *Function, args []Value) []Value {
+	errorsBefore := e.in.errorCount
+	vals := e.in.evaluateFunction(fn, args)
+	if e.in.errorCount != errorsBefore && e.errMsg == "" {
+		e.error(n, fmt.Sprintf("ошибка при вычислении функции %s", fn.name))
+		e.reported = true
+	}
+	return vals
+}
+
+// reportedError – ошибка вычисления, о которой уже сообщено в поток ошибок
+type reportedError struct{ msg string }
+
+func (r reportedError) Error() string { return r.msg }
+
+// failure – ошибка вычисления с указателем на место в исходном выражении src или nil
+func (e *evaluator) failure(src string) error {
+	if e.errMsg == "" {
+		return nil
+	}
+	if e.reported {
+		return reportedError{e.errMsg}
+	}
+	return fmt.Errorf("%s\n%s", e.errMsg, errorContext(src, e.errPos, e.errEnd))
+}
+
+// numbers – проверяет, что оба операнда – числа: арифметика и сравнения над массивами не определены
+func (e *evaluator) numbers(n *Node, a, b Value) bool {
+	if a.kind == KindArray || b.kind == KindArray {
+		e.error(n, "Операция не применима к массиву")
+		return false
+	}
+	if a.kind == KindString || b.kind == KindString {
+		e.error(n, "Операция не применима к строке")
+		return false
+	}
+	if a.kind != KindNumber || b.kind != KindNumber {
+		e.error(n, "Операция не применима к функции")
+		return false
+	}
+	return true
+}
 
-		val, ok := evaluateExpression(expr)
+func (e *evaluator) eval(n *Node) Value {
+	if e.errMsg != "" {
+		return Value{}
+	}
+	switch n.kind {
+	case NodeNumber, NodeString:
+		return n.val
+	case NodeVar:
+		v, ok := e.in.getVariable(n.name)
+		if fn, isFunc := e.in.functions[n.name]; !ok && isFunc {
+			// имя объявленной функции – значение-функция: apply(f, 2), compose(f, g)
+			return Value{kind: KindFunction, fn: fn}
+		}
 		if !ok {
-			return
+			// Ошибка: переменная не найдена
+			e.undefined(n, "переменной", n.name)
+			return Value{}
 		}
-		// Если переменная уже объявлена, берём её тип, иначе выводим из значения.
-		v, found := getVariable(varName)
-		if found {
-			// сохраняем значение с учётом её типа
-			if v.isInt {
-				v.value = float64(int64(val))
-			} else {
-				v.value = val
-			}
-		} else {
-			// Выводим тип из результата (если число целое, значит int, иначе float)
-			isInt := float64(int64(val)) == val
-			setVariable(varName, isInt, val)
+		return v.get()
+	case NodeNeg:
+		val := e.eval(n.args[0])
+		if val.kind != KindNumber {
+			e.error(n, "Унарный минус применим только к числам")
+			return Value{}
 		}
-		return
+		if val.isInt && val.ival != math.MinInt64 {
+			return intValue(-val.ival)
+		}
+		return Value{num: -val.num}
+	case NodeBinary:
+		return e.binary(n)
+	case NodeCompare:
+		return e.compare(n)
+	case NodeCall:
+		results, ok := e.call(n)
+		if !ok {
+			return Value{}
+		}
+		return e.single(n, n.name, results)
+	case NodeApply:
+		return e.applyValue(n)
+	case NodeIndex:
+		return e.index(n)
+	case NodeArray:
+		return e.array(n)
+	case NodeDefined:
+		// 1, если существует переменная или функция с таким именем, иначе 0
+		_, isVar := e.in.getVariable(n.name)
+		_, isFunc := e.in.getFunction(n.name)
+		return boolValue(isVar || isFunc)
+	case NodeMap:
+		return e.mapFunc(n)
 	}
-
-	// Если ничего из вышеперечисленного не подошло, считаем строку некорректной
-	fmt.Println("ОШИБКА: не могу разобрать инструкцию:", line)
+	return Value{} // кортеж допустим только как всё выражение (см. results)
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Использование: go run main.go <путь_к_файлу_инструкций>")
-		return
+// compare – цепочка сравнений. Как только одно из сравнений ложно, оставшиеся
+// операнды не вычисляются. Результат – целое 1 (истина) или 0 (ложь).
+func (e *evaluator) compare(n *Node) Value {
+	left := e.eval(n.args[0])
+	for i, op := range n.ops {
+		right := e.eval(n.args[i+1])
+		if e.errMsg != "" || !e.numbers(n, left, right) {
+			return Value{}
+		}
+		var result bool
+		if left.isInt && right.isInt {
+			result = compare(op, left.ival, right.ival)
+		} else {
+			result = compare(op, left.num, right.num)
+		}
+		if !result {
+			return boolValue(false)
+		}
+		left = right
 	}
+	return boolValue(true)
+}
 
-	fileName := os.Args[1]
-	file, err := os.Open(fileName)
-	if err != nil {
-		fmt.Println("Ошибка открытия файла:", err)
-		return
+// binary – арифметическая операция над двумя числами
+func (e *evaluator) binary(n *Node) Value {
+	left, right := e.eval(n.args[0]), e.eval(n.args[1])
+	if e.errMsg != "" || !e.numbers(n, left, right) {
+		return Value{}
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		processLine(line)
+	if e.in.strictTypes && left.isInt != right.isInt {
+		e.error(n, fmt.Sprintf("Смешение %s и %s без явного приведения: используйте int(...) или float(...)",
+			typeName(left), typeName(right)))
+		return Value{}
 	}
-	if err := scanner.Err(); err != nil {
-		fmt.Println("Ошибка чтения файла:", err)
-		return
+	switch n.op {
+	case TokenPlus:
+		if e.in.statsEnabled {
+			e.in.stats.additions++
+		}
+		return arith(left, right, addInt64, left.num+right.num)
+	case TokenMinus:
+		if e.in.statsEnabled {
+			e.in.stats.subtractions++
+		}
+		return arith(left, right, subInt64, left.num-right.num)
+	case TokenStar:
+		if e.in.statsEnabled {
+			e.in.stats.multiplications++
+		}
+		return arith(left, right, mulInt64, left.num*right.num)
+	case TokenCaret:
+		// Целое основание в неотрицательной целой степени даёт точное целое
+		// (без округления math.Pow за пределами 2^53); отрицательная или дробная
+		// степень и переполнение int64 дают float.
+		if e.in.statsEnabled {
+			e.in.stats.powers++
+		}
+		return arith(left, right, powInt64, math.Pow(left.num, right.num))
+	case TokenPercent, TokenMod:
+		return e.modulo(n, left, right)
+	}
+	// деление: "/" – обычное, "//" – с округлением вниз (-7 // 2 = -4)
+	if e.in.statsEnabled {
+		e.in.stats.divisions++
 	}
+	if right.num == 0 && e.in.strictDiv {
+		e.error(n, "Деление на ноль")
+		return Value{}
+	}
+	// Без --strict-div деление на 0.0 даёт +Inf/-Inf (или NaN для 0/0)
+	res := left.num / right.num
+	if n.op == TokenFloorDiv {
+		// для двух целых "//" – всегда целое, кроме деления на ноль
+		return arith(left, right, floorDivInt64, math.Floor(res))
+	}
+	// Частное двух целых остаётся целым, только если делится нацело
+	return arith(left, right, divInt64, res)
+}
 
-	variables = nil
-	functions = nil
+// modulo – остаток от деления. "%" – с усечением, как math.Mod: знак остатка –
+// как у делимого (-7 % 3 = -1); "mod" – с округлением частного вниз: знак – как
+// у делителя (-7 mod 3 = 2). Остаток двух целых – целое. Остаток от деления на ноль –
+// NaN (с --strict-div – ошибка).
+func (e *evaluator) modulo(n *Node, left, right Value) Value {
+	if e.in.statsEnabled {
+		e.in.stats.divisions++
+	}
+	if right.num == 0 {
+		if e.in.strictDiv {
+			e.error(n, "Деление на ноль")
+			return Value{}
+		}
+		return Value{num: math.NaN()}
+	}
+	floored := n.op == TokenMod
+	if left.isInt && right.isInt {
+		r := left.ival % right.ival
+		if floored && r != 0 && (r < 0) != (right.ival < 0) {
+			r += right.ival
+		}
+		return intValue(r)
+	}
+	r := math.Mod(left.num, right.num)
+	if floored && r != 0 && (r < 0) != (right.num < 0) {
+		r += right.num
+	}
+	return Value{num: r}
+}
+
+// array – литерал массива. Элементы – числа или функции (таблица вызовов [sq, cube]);
+// строки и вложенные массивы не поддерживаются.
+func (e *evaluator) array(n *Node) Value {
+	elems := make([]Value, 0, len(n.args))
+	for _, a := range n.args {
+		el := e.eval(a)
+		if el.kind == KindString {
+			e.error(a, "Элементы массива должны быть числами")
+			return Value{}
+		}
+		if el.kind == KindArray {
+			e.error(a, "Вложенные массивы не поддерживаются")
+			return Value{}
+		}
+		elems = append(elems, el)
+	}
+	return Value{kind: KindArray, arr: elems}
+}
+
+// index – элемент массива name[i]. Индексы начинаются с нуля; отрицательный
+// индекс отсчитывается с конца (a[-1] – последний).
+func (e *evaluator) index(n *Node) Value {
+	v, ok := e.in.getVariable(n.name)
+	if !ok {
+		e.undefined(n, "переменной", n.name)
+		return Value{}
+	}
+	arr := v.get()
+	idx := e.eval(n.args[0])
+	if e.errMsg != "" {
+		return Value{}
+	}
+	if arr.kind != KindArray {
+		e.error(n, fmt.Sprintf("Переменная %s не является массивом", n.name))
+		return Value{}
+	}
+	if idx.kind != KindNumber || !isWhole(idx.num) {
+		e.error(n.args[0], "Индекс массива должен быть целым числом")
+		return Value{}
+	}
+	i := int(idx.num)
+	if i < 0 {
+		i += len(arr.arr)
+	}
+	if i < 0 || i >= len(arr.arr) {
+		e.error(n, fmt.Sprintf("Индекс %d вне границ массива %s (длина %d)", int(idx.num), n.name, len(arr.arr)))
+		return Value{}
+	}
+	return arr.arr[i]
+}
+
+// mapFunc – встроенная функция map(f, a): новый массив из результатов применения
+// функции f к каждому элементу массива a; функция должна принимать ровно один аргумент.
+func (e *evaluator) mapFunc(n *Node) Value {
+	arr := e.eval(n.args[0])
+	if e.errMsg != "" {
+		return Value{}
+	}
+	fn, ok := e.in.getFunction(n.name)
+	if !ok {
+		e.undefined(n, "функции", n.name)
+		return Value{}
+	}
+	if len(fn.params) != 1 {
+		e.error(n, fmt.Sprintf("Функция map ожидала функцию одного аргумента, а %s принимает %d",
+			n.name, len(fn.params)))
+		return Value{}
+	}
+	if arr.kind != KindArray {
+		e.error(n.args[0], "Функция map ожидала массив вторым аргументом")
+		return Value{}
+	}
+
+	result := make([]Value, 0, len(arr.arr))
+	for _, el := range arr.arr {
+		args, err := fn.bindArgs([]Value{el})
+		if err != nil {
+			e.error(n, err.Error())
+			return Value{}
+		}
+		vals := e.invoke(n, fn, args)
+		if e.errMsg != "" {
+			return Value{}
+		}
+		if len(vals) != 1 || vals[0].kind != KindNumber {
+			e.error(n, fmt.Sprintf("Функция %s должна возвращать одно число для map", n.name))
+			return Value{}
+		}
+		result = append(result, vals[0])
+	}
+	return Value{kind: KindArray, arr: result}
+}
+
+// call – вычисляет аргументы и вызывает функцию n.name. Возвращает все значения
+// функции: их может быть несколько, если тело функции – кортеж.
+func (e *evaluator) call(n *Node) ([]Value, bool) {
+	args := e.args(n)
+	if e.errMsg != "" {
+		return nil, false
+	}
+	return e.apply(n, args)
+}
+
+// args – значения аргументов вызова n
+func (e *evaluator) args(n *Node) []Value {
+	args := make([]Value, len(n.args))
+	for i, a := range n.args {
+		args[i] = e.eval(a)
+	}
+	return args
+}
+
+// apply – вызов функции n.name с уже вычисленными аргументами
+func (e *evaluator) apply(n *Node, args []Value) ([]Value, bool) {
+	// Встроенные функции имеют приоритет над пользовательскими
+	if b, ok := builtins[n.name]; ok {
+		if msg := b.checkArity(n.name, len(args)); msg != "" {
+			e.error(n, msg)
+			return nil, false
+		}
+		var res Value
+		var err error
+		if b.state != nil {
+			res, err = b.state(e.in, args)
+		} else {
+			res, err = b.fn(args)
+		}
+		if err != nil {
+			e.error(n, fmt.Sprintf("Функция %s: %v", n.name, err))
+			return nil, false
+		}
+		return []Value{res}, true
+	}
+
+	// Ищем функцию
+	fn, ok := e.in.getFunction(n.name)
+	if !ok {
+		// Ошибка: функция не найдена
+		e.undefined(n, "функции", n.name)
+		return nil, false
+	}
+	return e.callFunc(n, fn, args)
+}
+
+// callFunc – вызов пользовательской функции fn (найденной по имени или
+// полученной как значение) с вычисленными аргументами
+func (e *evaluator) callFunc(n *Node, fn *Function, args []Value) ([]Value, bool) {
+	// Проверка числа параметров
+	if len(fn.params) != len(args) {
+		e.error(n, fmt.Sprintf("Функция %s ожидала %d аргументов, передано %d",
+			fn.name, len(fn.params), len(args)))
+		return nil, false
+	}
+
+	args, err := fn.bindArgs(args)
+	if err != nil {
+		e.error(n, err.Error())
+		return nil, false
+	}
+
+	// Вычисляем путём временного создания окружения
+	vals := e.invoke(n, fn, args)
+	return vals, e.errMsg == ""
+}
+
+// single – единственный результат вызова функции name: в скалярном контексте
+// кортеж из нескольких значений недопустим
+func (e *evaluator) single(n *Node, name string, results []Value) Value {
+	if len(results) != 1 {
+		e.error(n, fmt.Sprintf("Функция %s возвращает %d значений, а в выражении допустимо только одно",
+			name, len(results)))
+		return Value{}
+	}
+	return results[0]
+}
+
+// applyValue – вызов значения-функции, например элемента массива функций: fs[0](3)
+func (e *evaluator) applyValue(n *Node) Value {
+	callee := e.eval(n.args[0])
+	args := make([]Value, len(n.args)-1)
+	for i, a := range n.args[1:] {
+		args[i] = e.eval(a)
+	}
+	if e.errMsg != "" {
+		return Value{}
+	}
+	if callee.kind != KindFunction {
+		e.error(n.args[0], fmt.Sprintf("Значение типа %s не является функцией", typeName(callee)))
+		return Value{}
+	}
+	results, ok := e.callFunc(n, callee.fn, args)
+	if !ok {
+		return Value{}
+	}
+	return e.single(n, callee.fn.name, results)
+}
+
+// results – значения выражения, разобранного parseResults: несколько для кортежа
+// и для вызова функции, возвращающей кортеж; ровно одно для любого другого выражения
+func (e *evaluator) results(n *Node) []Value {
+	switch n.kind {
+	case NodeTuple:
+		vals := make([]Value, len(n.args))
+		for i, a := range n.args {
+			vals[i] = e.eval(a)
+		}
+		return vals
+	case NodeCall:
+		vals, _ := e.call(n)
+		return vals
+	}
+	return []Value{e.eval(n)}
+}
+
+// parseExpr – разбирает выражение src в дерево; при multi допускается несколько
+// значений (см. parseResults). Ошибка содержит сообщение и исходное выражение
+// с указателем на место ошибки.
+func (in *Interpreter) parseExpr(src string, multi bool) (*Node, error) {
+	if in.parsed == nil {
+		in.parsed = newExprCache(exprCacheSize)
+	}
+	// разбор зависит только от текста, режима multi и флага --eq-compat
+	key := fmt.Sprintf("%t %t %s", multi, in.eqCompat, src)
+	if root, ok := in.parsed.get(key); ok {
+		if in.statsEnabled {
+			in.stats.cacheHits++
+		}
+		return root, nil
+	}
+	if in.statsEnabled {
+		in.stats.parses++
+	}
+	p := NewParser(in, src)
+	var root *Node
+	if multi {
+		root = p.parseResults()
+	} else {
+		root = p.parseExpression()
+	}
+	p.expectEnd()
+	if p.errMsg != "" {
+		return nil, fmt.Errorf("%s\n%s", p.errMsg, errorContext(src, p.errPos, p.errEnd))
+	}
+	in.parsed.put(key, root)
+	return root, nil
+}
+
+// Число деревьев разбора в кэше выражений
+const exprCacheSize = 256
+
+// exprCache – LRU-кэш деревьев разбора: выражение, вычисляемое повторно (в цикле,
+// в теле функции), не разбирается заново. Ключ – сам текст выражения, а дерево
+// не зависит от значений переменных и не меняется при вычислении, поэтому кэш
+// не нужно сбрасывать. При переполнении вытесняется давно не использованное дерево.
+type exprCache struct {
+	capacity int
+	order    *list.List               // элементы *cacheEntry, в начале – недавно использованные
+	entries  map[string]*list.Element // ключ -> элемент order
+}
+
+type cacheEntry struct {
+	key  string
+	root *Node
+}
+
+func newExprCache(capacity int) *exprCache {
+	return &exprCache{capacity: capacity, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get – дерево из кэша; найденное дерево становится недавно использованным
+func (c *exprCache) get(key string) (*Node, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).root, true
+}
+
+// put – добавляет дерево, при необходимости вытесняя давно не использованное
+func (c *exprCache) put(key string, root *Node) {
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*cacheEntry).root = root
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, root: root})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// dumpAST – режим --ast: выводит дерево разбора выражения в виде S-выражения,
+// ничего не вычисляя
+func (in *Interpreter) dumpAST(expr string, multi bool) {
+	root, err := in.parseExpr(expr, multi)
+	if err != nil {
+		in.reportError("ОШИБКА при разборе выражения: %v", err)
+		return
+	}
+	fmt.Fprintln(in.Out, root)
+}
+
+// evaluateFunction – вызов функции с уже приведёнными аргументами. Для функции,
+// отмеченной командой memoize, результат берётся из кэша, если функция уже
+// вызывалась с такими же аргументами; результат вызова с ошибкой не кэшируется.
+func (in *Interpreter) evaluateFunction(fn *Function, args []Value) []Value {
+	if in.profileEnabled {
+		defer in.profileCall(fn.name)()
+	}
+	if fn.memo == nil {
+		return in.callFunction(fn, args)
+	}
+	key := memoKey(args)
+	if vals, ok := fn.memo[key]; ok {
+		return vals
+	}
+	errorsBefore := in.errorCount
+	vals := in.callFunction(fn, args)
+	if in.errorCount == errorsBefore {
+		fn.memo[key] = vals
+	}
+	return vals
+}
+
+// profileCall – начинает замер вызова функции name для --profile; возвращает
+// функцию, завершающую замер (вызывается через defer, в том числе при панике)
+func (in *Interpreter) profileCall(name string) func() {
+	if in.profile == nil {
+		in.profile = make(map[string]*funcProfile)
+	}
+	p := in.profile[name]
+	if p == nil {
+		p = &funcProfile{}
+		in.profile[name] = p
+	}
+	p.calls++
+	p.active++
+	start := time.Now()
+	return func() {
+		p.active--
+		if p.active == 0 {
+			p.total += time.Since(start)
+		}
+	}
+}
+
+// printProfile – итог --profile: суммарное время каждой функции по убыванию
+func (in *Interpreter) printProfile() {
+	names := make([]string, 0, len(in.profile))
+	for name := range in.profile {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := in.profile[names[i]], in.profile[names[j]]
+		if a.total != b.total {
+			return a.total > b.total
+		}
+		return names[i] < names[j]
+	})
+	fmt.Fprintln(in.Out, "== Профиль функций ==")
+	for _, name := range names {
+		p := in.profile[name]
+		fmt.Fprintf(in.Out, "  %s: %v (вызовов: %d)\n", name, p.total, p.calls)
+	}
+}
+
+// memoKey – ключ кэша memoize: типы и значения аргументов
+func memoKey(args []Value) string {
+	parts := make([]string, len(args))
+	for i, a := range args {
+		text := formatValue(a)
+		switch {
+		case a.kind == KindNumber && a.isInt:
+			text = strconv.FormatInt(a.ival, 10)
+		case a.kind == KindNumber:
+			// точное представление, не зависящее от формата вывода
+			text = strconv.FormatFloat(a.num, 'g', -1, 64)
+		}
+		parts[i] = typeName(a) + ":" + text
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// callFunction – вычисляет тело функции, подставляя аргументы в параметры.
+// Для простоты делаем: во время вычисления выражения функции создаём «временные» переменные с именами параметров
+// и после вычисления восстанавливаем старые значения (или отсутствие таковых).
+// Если тело функции – кортеж, возвращается несколько значений. Значения сохраняют
+// тип, выведенный из тела (int или float), поэтому результат вызова в выражении
+// форматируется так же, как переменная этого типа.
+func (in *Interpreter) callFunction(fn *Function, args []Value) []Value {
+	in.checkRuntime()
+	if len(in.callStack) >= in.maxDepth {
+		panic(recursionError{limit: in.maxDepth, fn: fn.name})
+	}
+	// вызов, результат которого взят из кэша memoize, сюда не доходит и не считается
+	if in.statsEnabled {
+		if in.stats.funcCalls == nil {
+			in.stats.funcCalls = make(map[string]int)
+		}
+		in.stats.calls++
+		in.stats.funcCalls[fn.name]++
+	}
+	if fn.composed != nil {
+		return in.evaluateComposed(fn, args)
+	}
+
+	// Сохраним текущее состояние переменных, которые совпадают с именами параметров.
+	// Параметр заменяет переменную целиком (а не меняет её на месте), поэтому
+	// достаточно запомнить исходный указатель.
+	backup := make(map[string]*Variable)
+	in.callStack = append(in.callStack, fn)
+	// Восстановление – в defer, чтобы глобальные переменные вернулись
+	// при любом выходе из функции (в том числе по ошибке или панике)
+	defer func() {
+		in.callStack = in.callStack[:len(in.callStack)-1]
+
+		// Восстановим старые значения переменных
+		for _, param := range fn.params {
+			// Удаляем временную переменную (или восстанавливаем из backup)
+			delete(in.variables, param.name)
+			if bkp, ok := backup[param.name]; ok {
+				// восстановить
+				in.variables[param.name] = bkp
+			}
+		}
+	}()
+	// Для каждого параметра создаём/перезаписываем переменную
+	for i, param := range fn.params {
+		if orig, found := in.getVariable(param.name); found {
+			backup[param.name] = orig
+		}
+		// Аргумент уже приведён к объявленному типу параметра (см. bindArgs)
+		in.variables[param.name] = newVariable(args[i])
+	}
+
+	// Вычислим выражение
+	root, err := in.parseExpr(fn.expression, true)
+	if err != nil {
+		in.reportError("ОШИБКА при вычислении функции %s: %v", fn.name, err)
+		return []Value{{}}
+	}
+	e := &evaluator{in: in}
+	vals := e.results(root)
+	if err := e.failure(fn.expression); err != nil && !e.reported {
+		in.reportError("ОШИБКА при вычислении функции %s: %v", fn.name, err)
+	}
+	return vals
+}
+
+// probeCall – вычисляет вызов функции call (разобранный из expr) и возвращает
+// значения аргументов и результаты (команда probe)
+func (in *Interpreter) probeCall(call *Node, expr string) (args, vals []Value, err error) {
+	defer recoverRecursion(&err)
+	e := &evaluator{in: in}
+	args = e.args(call)
+	if e.errMsg == "" {
+		vals, _ = e.apply(call, args)
+	}
+	if err := e.failure(expr); err != nil {
+		return nil, nil, err
+	}
+	return args, vals, nil
+}
+
+// probe – команда "probe f(2, 3)": вызывает функцию и выводит одной строкой
+// имя, значения аргументов и результат: "f(2, 3) -> 5"
+func (in *Interpreter) probe(expr string) {
+	if in.astOnly {
+		in.dumpAST(expr, false)
+		return
+	}
+	root, err := in.parseExpr(expr, false)
+	if err != nil {
+		in.reportError("ОШИБКА при вычислении выражения: %v", err)
+		return
+	}
+	if root.kind != NodeCall {
+		in.reportError("ОШИБКА: probe ожидает вызов функции, например probe f(2, 3): %s", expr)
+		return
+	}
+	args, vals, err := in.probeCall(root, expr)
+	if err != nil {
+		if !errors.As(err, new(reportedError)) {
+			in.reportError("ОШИБКА при вычислении выражения: %v", err)
+		}
+		return
+	}
+	argTexts := make([]string, len(args))
+	for i, a := range args {
+		argTexts[i] = in.printValue(a)
+	}
+	results := make([]string, len(vals))
+	for i, v := range vals {
+		results[i] = in.printValue(v)
+	}
+	in.printResult(fmt.Sprintf("%s(%s) -> %s", root.name, strings.Join(argTexts, ", "), strings.Join(results, ", ")))
+}
+
+// evaluateComposed – вызов композиции compose(f, g): результат g передаётся в f
+func (in *Interpreter) evaluateComposed(fn *Function, args []Value) []Value {
+	vals := args
+	for i := len(fn.composed) - 1; i >= 0; i-- {
+		inner := fn.composed[i]
+		if len(vals) != 1 {
+			in.reportError("ОШИБКА при вычислении функции %s: функция %s должна возвращать одно значение",
+				fn.name, fn.composed[i+1].name)
+			return []Value{{}}
+		}
+		bound, err := inner.bindArgs(vals)
+		if err != nil {
+			in.reportError("ОШИБКА при вычислении функции %s: %v", fn.name, err)
+			return []Value{{}}
+		}
+		vals = in.evaluateFunction(inner, bound)
+	}
+	return vals
+}
+
+// evaluateExpression – вспомогательная функция для вычисления произвольной строки-выражения.
+// В режиме --ast выражение только выводится в виде дерева (ok = false: инструкция не выполняется).
+func (in *Interpreter) evaluateExpression(expr string) (Value, bool) {
+	if in.astOnly {
+		in.dumpAST(expr, false)
+		return Value{}, false
+	}
+	val, err := in.evalExpr(expr)
+	if err != nil {
+		if !errors.As(err, new(reportedError)) {
+			in.reportError("ОШИБКА при вычислении выражения: %v", err)
+		}
+		return Value{}, false
+	}
+	return val, true
+}
+
+// Eval – вычисляет выражение в текущем состоянии интерпретатора и возвращает
+// значение вместе с его типом (для встраивания интерпретатора в другие программы).
+// Ошибка содержит сообщение и исходное выражение с указателем на место ошибки.
+// Превышение --max-runtime тоже возвращается как ошибка.
+func (in *Interpreter) Eval(expr string) (val Value, err error) {
+	defer recoverTimeout(&err)
+	return in.evalExpr(expr)
+}
+
+// evalExpr – как Eval, но превышение --max-runtime прерывает и инструкцию,
+// в которой вычисляется выражение (паника timeoutError не перехватывается)
+func (in *Interpreter) evalExpr(expr string) (val Value, err error) {
+	defer recoverRecursion(&err)
+	root, err := in.parseExpr(expr, false)
+	if err != nil {
+		return Value{}, err
+	}
+	e := &evaluator{in: in}
+	val = e.eval(root)
+	if err := e.failure(expr); err != nil {
+		return Value{}, err
+	}
+	return val, nil
+}
+
+// evalResults – как Eval, но допускает несколько значений (кортеж)
+func (in *Interpreter) evalResults(expr string) (vals []Value, err error) {
+	defer recoverRecursion(&err)
+	root, err := in.parseExpr(expr, true)
+	if err != nil {
+		return nil, err
+	}
+	e := &evaluator{in: in}
+	vals = e.results(root)
+	if err := e.failure(expr); err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// evaluateResults – как evaluateExpression, но допускает несколько значений (кортеж)
+func (in *Interpreter) evaluateResults(expr string) ([]Value, bool) {
+	if in.astOnly {
+		in.dumpAST(expr, true)
+		return nil, false
+	}
+	vals, err := in.evalResults(expr)
+	if err != nil {
+		if !errors.As(err, new(reportedError)) {
+			in.reportError("ОШИБКА при вычислении выражения: %v", err)
+		}
+		return nil, false
+	}
+	return vals, true
+}
+
+// recursionError – слишком глубокая рекурсия: evaluateFunction выходит из всех
+// вложенных вызовов паникой с этим значением, а Eval и evalResults превращают её
+// в обычную ошибку выражения (глобальные переменные восстанавливаются в defer)
+type recursionError struct {
+	limit int    // ограничение глубины (флаг --max-depth)
+	fn    string // функция, вызов которой превысил ограничение
+}
+
+func (e recursionError) Error() string {
+	return fmt.Sprintf("превышена глубина рекурсии %d при вызове функции %s (флаг --max-depth)", e.limit, e.fn)
+}
+
+// recoverRecursion – перехватывает выход из слишком глубокой рекурсии и
+// записывает его в *err; остальные паники не перехватываются
+func recoverRecursion(err *error) {
+	if r := recover(); r != nil {
+		re, ok := r.(recursionError)
+		if !ok {
+			panic(r)
+		}
+		*err = re
+	}
+}
+
+// === Встроенные функции ===
+
+// Builtin – встроенная функция, реализованная на Go. Аргументы вычисляются заранее.
+type Builtin struct {
+	minArgs int                               // наименьшее число аргументов
+	maxArgs int                               // наибольшее число аргументов; -1 – без ограничения
+	fn      func(args []Value) (Value, error) // вычисление результата
+
+	// вычисление, которому нужно состояние интерпретатора (задаётся вместо fn)
+	state func(in *Interpreter, args []Value) (Value, error)
+}
+
+var builtins = map[string]*Builtin{
+	"int":               {minArgs: 1, maxArgs: 1, fn: builtinInt},
+	"float":             {minArgs: 1, maxArgs: 1, fn: builtinFloat},
+	"min":               {minArgs: 1, maxArgs: -1, fn: builtinMin},
+	"max":               {minArgs: 1, maxArgs: -1, fn: builtinMax},
+	"sumrange":          {minArgs: 2, maxArgs: 2, fn: builtinSumRange},
+	"prodrange":         {minArgs: 2, maxArgs: 2, fn: builtinProdRange},
+	"len":               {minArgs: 1, maxArgs: 1, fn: builtinLen},
+	"gcd":               {minArgs: 2, maxArgs: 2, fn: builtinGcd},
+	"lcm":               {minArgs: 2, maxArgs: 2, fn: builtinLcm},
+	"lerp":              {minArgs: 3, maxArgs: 3, fn: builtinLerp},
+	"argmin":            {minArgs: 1, maxArgs: 1, fn: builtinArgMin},
+	"format":            {minArgs: 1, maxArgs: -1, fn: builtinFormat},
+	"argmax":            {minArgs: 1, maxArgs: 1, fn: builtinArgMax},
+	"clamp01":           {minArgs: 1, maxArgs: 1, fn: builtinClamp01},
+	"hypot":             {minArgs: 2, maxArgs: 2, fn: builtinHypot},
+	"atan2":             {minArgs: 2, maxArgs: 2, fn: builtinAtan2},
+	"degrees":           {minArgs: 1, maxArgs: 1, fn: builtinDegrees},
+	"env":               {minArgs: 1, maxArgs: 1, fn: builtinEnv},
+	"envnum":            {minArgs: 1, maxArgs: 1, fn: builtinEnvNum},
+	"radians":           {minArgs: 1, maxArgs: 1, fn: builtinRadians},
+	"compose":           {minArgs: 2, maxArgs: 2, fn: builtinCompose},
+	"iseven":            {minArgs: 1, maxArgs: 1, fn: builtinIsEven},
+	"isodd":             {minArgs: 1, maxArgs: 1, fn: builtinIsOdd},
+	"wrap":              {minArgs: 3, maxArgs: 3, fn: builtinWrap},
+	"between":           {minArgs: 3, maxArgs: 3, fn: builtinBetween},
+	"between_exclusive": {minArgs: 3, maxArgs: 3, fn: builtinBetweenExclusive},
+
+	"count_vars":  {minArgs: 0, maxArgs: 0, state: builtinCountVars},
+	"count_funcs": {minArgs: 0, maxArgs: 0, state: builtinCountFuncs},
+}
+
+// checkArity – сообщение об ошибке, если встроенной функции name передано
+// неподходящее число аргументов n, иначе пустая строка. Формат совпадает
+// с сообщением для пользовательских функций.
+func (b *Builtin) checkArity(name string, n int) string {
+	switch {
+	case b.minArgs == b.maxArgs && n != b.minArgs:
+		return fmt.Sprintf("Функция %s ожидала %d аргументов, передано %d", name, b.minArgs, n)
+	case n < b.minArgs:
+		return fmt.Sprintf("Функция %s ожидала не менее %d аргументов, передано %d", name, b.minArgs, n)
+	case b.maxArgs >= 0 && n > b.maxArgs:
+		return fmt.Sprintf("Функция %s ожидала не более %d аргументов, передано %d", name, b.maxArgs, n)
+	}
+	return ""
+}
+
+// numArgs – проверяет, что все аргументы встроенной функции – числа
+func numArgs(args []Value) error {
+	for _, a := range args {
+		if a.kind != KindNumber {
+			return errors.New("аргументы должны быть числами")
+		}
+	}
+	return nil
+}
+
+// numElems – проверяет, что все элементы массива – числа (массив может хранить и функции)
+func numElems(elems []Value) error {
+	for _, el := range elems {
+		if el.kind != KindNumber {
+			return errors.New("элементы массива должны быть числами")
+		}
+	}
+	return nil
+}
+
+// builtinInt – приведение к целому: int(x) отбрасывает дробную часть (к нулю)
+func builtinInt(args []Value) (Value, error) {
+	if err := numArgs(args); err != nil {
+		return Value{}, err
+	}
+	i, ok := toInt(args[0])
+	if !ok {
+		return Value{}, fmt.Errorf("число слишком большое для int: %g", args[0].num)
+	}
+	return intValue(i), nil
+}
+
+// builtinFloat – приведение к вещественному: float(x) оставляет число как есть,
+// но помечает результат вещественным, что влияет на вывод типа переменной при присваивании
+func builtinFloat(args []Value) (Value, error) {
+	if err := numArgs(args); err != nil {
+		return Value{}, err
+	}
+	return Value{num: args[0].num}, nil
+}
+
+// builtinMin – min(a, b, ...): наименьший из аргументов (с его типом)
+func builtinMin(args []Value) (Value, error) {
+	if err := numArgs(args); err != nil {
+		return Value{}, err
+	}
+	res := args[0]
+	for _, a := range args[1:] {
+		if a.num < res.num {
+			res = a
+		}
+	}
+	return res, nil
+}
+
+// builtinMax – max(a, b, ...): наибольший из аргументов (с его типом)
+func builtinMax(args []Value) (Value, error) {
+	if err := numArgs(args); err != nil {
+		return Value{}, err
+	}
+	res := args[0]
+	for _, a := range args[1:] {
+		if a.num > res.num {
+			res = a
+		}
+	}
+	return res, nil
+}
+
+// intArg – целочисленный аргумент встроенной функции; дробные значения
+// и массивы – ошибка (без неявного округления)
+func intArg(v Value) (int64, error) {
+	if v.kind == KindNumber && v.isInt {
+		return v.ival, nil
+	}
+	if v.kind != KindNumber || !isWhole(v.num) {
+		return 0, errors.New("аргументы должны быть целыми числами")
+	}
+	return int64(v.num), nil
+}
+
+// rangeBounds – границы диапазона целых чисел; порядок границ не важен:
+// убывающий диапазон (5, 1) содержит те же числа, что и (1, 5)
+func rangeBounds(args []Value) (int64, int64, error) {
+	lo, err := intArg(args[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	hi, err := intArg(args[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	return lo, hi, nil
+}
+
+// builtinSumRange – sumrange(lo, hi): сумма целых чисел от lo до hi включительно
+// (по формуле арифметической прогрессии)
+func builtinSumRange(args []Value) (Value, error) {
+	lo, hi, err := rangeBounds(args)
+	if err != nil {
+		return Value{}, err
+	}
+	// (lo + hi) * n / 2, где один из множителей чётный; если промежуточные
+	// значения переполняют int64 – точный расчёт в big.Int, а результат,
+	// не помещающийся в int64, – вещественный
+	d, dok := subInt64(hi, lo)
+	n, nok := addInt64(d, 1)
+	s, sok := addInt64(lo, hi)
+	if dok && nok && sok {
+		if n%2 == 0 {
+			n /= 2
+		} else {
+			s /= 2
+		}
+		if res, ok := mulInt64(n, s); ok {
+			return intValue(res), nil
+		}
+	}
+	count := new(big.Int).Sub(big.NewInt(hi), big.NewInt(lo))
+	count.Add(count, big.NewInt(1))
+	sum := new(big.Int).Add(big.NewInt(lo), big.NewInt(hi))
+	sum.Mul(sum, count).Quo(sum, big.NewInt(2))
+	if sum.IsInt64() {
+		return intValue(sum.Int64()), nil
+	}
+	f, _ := new(big.Float).SetInt(sum).Float64()
+	return Value{num: f}, nil
+}
+
+// builtinLen – len(a): число элементов массива (целое)
+func builtinLen(args []Value) (Value, error) {
+	if args[0].kind != KindArray {
+		return Value{}, errors.New("аргумент должен быть массивом")
+	}
+	return intValue(int64(len(args[0].arr))), nil
+}
+
+// builtinFormat – format("%d-%d", a, b): строка по шаблону, как printf, но без вывода.
+// Форматы: %d и %x – целые, %f, %g, %e – числа, %s – любое значение, %% – знак '%';
+// между '%' и буквой допустимы флаги, ширина и точность (%5.2f).
+// Несоответствие форматов и аргументов – ошибка.
+func builtinFormat(args []Value) (Value, error) {
+	if args[0].kind != KindString {
+		return Value{}, errors.New("первый аргумент должен быть строкой формата")
+	}
+	tmpl, rest := args[0].str, args[1:]
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' {
+			b.WriteByte(tmpl[i])
+			continue
+		}
+		j := i + 1
+		for j < len(tmpl) && strings.IndexByte("+-# 0123456789.", tmpl[j]) >= 0 {
+			j++
+		}
+		if j == len(tmpl) {
+			return Value{}, fmt.Errorf("незавершённый формат %s", tmpl[i:])
+		}
+		spec := tmpl[i : j+1]
+		i = j
+		if tmpl[j] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		if n >= len(rest) {
+			return Value{}, fmt.Errorf("для формата %s не хватает аргумента", spec)
+		}
+		a := rest[n]
+		n++
+		switch tmpl[j] {
+		case 'd', 'x':
+			if a.kind != KindNumber || !a.isInt {
+				return Value{}, fmt.Errorf("формат %s ожидает целое, получено %s", spec, typeName(a))
+			}
+			fmt.Fprintf(&b, spec, a.ival)
+		case 'f', 'g', 'e':
+			if a.kind != KindNumber {
+				return Value{}, fmt.Errorf("формат %s ожидает число, получено %s", spec, typeName(a))
+			}
+			fmt.Fprintf(&b, spec, a.num)
+		case 's':
+			fmt.Fprintf(&b, spec, formatValue(a))
+		default:
+			return Value{}, fmt.Errorf("неизвестный формат %s", spec)
+		}
+	}
+	if n < len(rest) {
+		return Value{}, fmt.Errorf("лишние аргументы: форматов %d, аргументов %d", n, len(rest))
+	}
+	return Value{kind: KindString, str: b.String()}, nil
+}
+
+// argBest – индекс первого элемента массива, для которого better(элемент, лучший) истинно
+// относительно всех предыдущих; при равенстве остаётся первое вхождение
+func argBest(args []Value, better func(a, b float64) bool) (Value, error) {
+	arr := args[0]
+	if arr.kind != KindArray {
+		return Value{}, errors.New("аргумент должен быть массивом")
+	}
+	if len(arr.arr) == 0 {
+		return Value{}, errors.New("массив пуст")
+	}
+	if err := numElems(arr.arr); err != nil {
+		return Value{}, err
+	}
+	best := 0
+	for i, el := range arr.arr[1:] {
+		if better(el.num, arr.arr[best].num) {
+			best = i + 1
+		}
+	}
+	return intValue(int64(best)), nil
+}
+
+// builtinArgMin – argmin(a): индекс наименьшего элемента массива
+func builtinArgMin(args []Value) (Value, error) {
+	return argBest(args, func(a, b float64) bool { return a < b })
+}
+
+// builtinArgMax – argmax(a): индекс наибольшего элемента массива
+func builtinArgMax(args []Value) (Value, error) {
+	return argBest(args, func(a, b float64) bool { return a > b })
+}
+
+// builtinLerp – lerp(a, b, t): линейная интерполяция a + (b-a)*t
+func builtinLerp(args []Value) (Value, error) {
+	if err := numArgs(args); err != nil {
+		return Value{}, err
+	}
+	a, b, t := args[0].num, args[1].num, args[2].num
+	return Value{num: a + (b-a)*t}, nil
+}
+
+// builtinHypot – hypot(x, y): длина гипотенузы sqrt(x*x + y*y) без переполнения
+// промежуточных результатов; результат вещественный
+func builtinHypot(args []Value) (Value, error) {
+	if err := numArgs(args); err != nil {
+		return Value{}, err
+	}
+	return Value{num: math.Hypot(args[0].num, args[1].num)}, nil
+}
+
+// builtinAtan2 – atan2(y, x): угол точки (x, y) в радианах, от -pi до pi;
+// знаки аргументов определяют четверть
+func builtinAtan2(args []Value) (Value, error) {
+	if err := numArgs(args); err != nil {
+		return Value{}, err
+	}
+	return Value{num: math.Atan2(args[0].num, args[1].num)}, nil
+}
+
+// builtinDegrees – degrees(r): угол r в радианах, переведённый в градусы (pi – 180)
+func builtinDegrees(args []Value) (Value, error) {
+	if err := numArgs(args); err != nil {
+		return Value{}, err
+	}
+	return Value{num: args[0].num * 180 / math.Pi}, nil
+}
+
+// builtinRadians – radians(d): угол d в градусах, переведённый в радианы (180 – pi)
+func builtinRadians(args []Value) (Value, error) {
+	if err := numArgs(args); err != nil {
+		return Value{}, err
+	}
+	return Value{num: args[0].num * math.Pi / 180}, nil
+}
+
+// builtinEnv – env("NAME"): значение переменной окружения NAME (строка);
+// не заданная переменная – ошибка
+func builtinEnv(args []Value) (Value, error) {
+	if args[0].kind != KindString {
+		return Value{}, errors.New("аргумент должен быть строкой с именем переменной окружения")
+	}
+	text, ok := os.LookupEnv(args[0].str)
+	if !ok {
+		return Value{}, fmt.Errorf("переменная окружения %s не задана", args[0].str)
+	}
+	return Value{kind: KindString, str: text}, nil
+}
+
+// builtinEnvNum – envnum("NAME"): числовое значение переменной окружения NAME
+// (целое или вещественное, как во вводе input); не заданная или не числовая
+// переменная – ошибка
+func builtinEnvNum(args []Value) (Value, error) {
+	s, err := builtinEnv(args)
+	if err != nil {
+		return Value{}, err
+	}
+	val, ok := parseNumber(strings.TrimSpace(s.str))
+	if !ok {
+		return Value{}, fmt.Errorf("переменная окружения %s – не число: %q", args[0].str, s.str)
+	}
+	return val, nil
+}
+
+// builtinIsEven – iseven(n): 1, если целое n чётное, иначе 0
+func builtinIsEven(args []Value) (Value, error) {
+	n, err := intArg(args[0])
+	if err != nil {
+		return Value{}, err
+	}
+	return boolValue(n%2 == 0), nil
+}
+
+// builtinIsOdd – isodd(n): 1, если целое n нечётное, иначе 0 (для отрицательных тоже: isodd(-3) = 1)
+func builtinIsOdd(args []Value) (Value, error) {
+	n, err := intArg(args[0])
+	if err != nil {
+		return Value{}, err
+	}
+	return boolValue(n%2 != 0), nil
+}
+
+// builtinBetween – between(x, lo, hi): 1, если lo <= x <= hi (границы включаются), иначе 0
+func builtinBetween(args []Value) (Value, error) {
+	return inRange(args, TokenLessEq)
+}
+
+// builtinBetweenExclusive – between_exclusive(x, lo, hi): 1, если lo < x < hi, иначе 0
+func builtinBetweenExclusive(args []Value) (Value, error) {
+	return inRange(args, TokenLess)
+}
+
+// inRange – проверка lo op x op hi для аргументов (x, lo, hi); целые сравниваются
+// точно, как в цепочке сравнений. При lo > hi результат – 0.
+func inRange(args []Value, op TokenType) (Value, error) {
+	if err := numArgs(args); err != nil {
+		return Value{}, err
+	}
+	x, lo, hi := args[0], args[1], args[2]
+	before := func(a, b Value) bool {
+		if a.isInt && b.isInt {
+			return compare(op, a.ival, b.ival)
+		}
+		return compare(op, a.num, b.num)
+	}
+	return boolValue(before(lo, x) && before(x, hi)), nil
+}
+
+// builtinCountVars – count_vars(): число объявленных переменных (во время вызова
+// функции – вместе с её параметрами)
+func builtinCountVars(in *Interpreter, args []Value) (Value, error) {
+	return intValue(int64(len(in.variables))), nil
+}
+
+// builtinCountFuncs – count_funcs(): число объявленных функций (без встроенных
+// и без лямбд, хранящихся в переменных)
+func builtinCountFuncs(in *Interpreter, args []Value) (Value, error) {
+	return intValue(int64(len(in.functions))), nil
+}
+
+// builtinCompose – compose(f, g): новая функция одного аргумента, вычисляющая f(g(x));
+// f и g – функции (объявленные или лямбды) одного аргумента. Параметр новой
+// функции получает тип параметра g.
+func builtinCompose(args []Value) (Value, error) {
+	for _, a := range args {
+		if a.kind != KindFunction || len(a.fn.params) != 1 {
+			return Value{}, errors.New("аргументы должны быть функциями одного аргумента")
+		}
+	}
+	f, g := args[0].fn, args[1].fn
+	param := g.params[0]
+	fn := &Function{
+		name:       "compose(" + f.name + ", " + g.name + ")",
+		params:     []Param{param},
+		expression: f.name + "(" + g.name + "(" + param.name + "))",
+		composed:   []*Function{f, g},
+	}
+	return Value{kind: KindFunction, fn: fn}, nil
+}
+
+// builtinWrap – wrap(x, lo, hi): x, циклически приведённое к полуинтервалу [lo, hi):
+// wrap(370, 0, 360) = 10, wrap(-90, 0, 360) = 270. Для трёх целых результат целый.
+func builtinWrap(args []Value) (Value, error) {
+	if err := numArgs(args); err != nil {
+		return Value{}, err
+	}
+	x, lo, hi := args[0], args[1], args[2]
+	if lo.num >= hi.num {
+		return Value{}, fmt.Errorf("нижняя граница %s должна быть меньше верхней %s", formatValue(lo), formatValue(hi))
+	}
+	if x.isInt && lo.isInt && hi.isInt {
+		if span, ok := subInt64(hi.ival, lo.ival); ok {
+			if off, ok := subInt64(x.ival, lo.ival); ok {
+				m := off % span
+				if m < 0 {
+					m += span
+				}
+				return intValue(lo.ival + m), nil
+			}
+		}
+	}
+	span := hi.num - lo.num
+	m := math.Mod(x.num-lo.num, span)
+	if m < 0 {
+		m += span
+	}
+	res := lo.num + m
+	if res >= hi.num {
+		res = lo.num // m + span округлилось до span
+	}
+	return Value{num: res}, nil
+}
+
+// builtinClamp01 – clamp01(x): x, ограниченное отрезком [0, 1]; тип аргумента сохраняется
+func builtinClamp01(args []Value) (Value, error) {
+	if err := numArgs(args); err != nil {
+		return Value{}, err
+	}
+	res := args[0]
+	switch {
+	case res.num < 0 && res.isInt:
+		res = intValue(0)
+	case res.num > 1 && res.isInt:
+		res = intValue(1)
+	case res.num < 0:
+		res.num = 0
+	case res.num > 1:
+		res.num = 1
+	}
+	return res, nil
+}
+
+// gcdArgs – целые аргументы gcd/lcm по модулю и их наибольший общий делитель
+// (алгоритм Евклида; gcd(0, 0) = 0)
+func gcdArgs(args []Value) (a, b, g int64, err error) {
+	if a, err = intArg(args[0]); err != nil {
+		return
+	}
+	if b, err = intArg(args[1]); err != nil {
+		return
+	}
+	if a < 0 {
+		a = -a
+	}
+	if b < 0 {
+		b = -b
+	}
+	g, r := a, b
+	for r != 0 {
+		g, r = r, g%r
+	}
+	return
+}
+
+// builtinGcd – gcd(a, b): наибольший общий делитель
+func builtinGcd(args []Value) (Value, error) {
+	_, _, g, err := gcdArgs(args)
+	if err != nil {
+		return Value{}, err
+	}
+	return intValue(g), nil
+}
+
+// builtinLcm – lcm(a, b): наименьшее общее кратное; lcm(0, x) = 0
+func builtinLcm(args []Value) (Value, error) {
+	a, b, g, err := gcdArgs(args)
+	if err != nil {
+		return Value{}, err
+	}
+	if g == 0 {
+		return intValue(0), nil
+	}
+	res, ok := mulInt64(a/g, b)
+	if !ok {
+		return Value{}, errors.New("результат слишком большой для целого числа")
+	}
+	return intValue(res), nil
+}
+
+// builtinProdRange – prodrange(lo, hi): произведение целых чисел от lo до hi включительно
+func builtinProdRange(args []Value) (Value, error) {
+	lo, hi, err := rangeBounds(args)
+	if err != nil {
+		return Value{}, err
+	}
+	// диапазон с нулём даёт ноль; в остальных все множители одного знака
+	if lo <= 0 && hi >= 0 {
+		return intValue(0), nil
+	}
+	// точное целое произведение, пока оно помещается в int64, дальше – вещественное.
+	// Модуль произведения растёт не медленнее факториала, поэтому после переполнения
+	// float64 перебор прекращается: длинный диапазон не перебирается целиком.
+	// Условие выхода проверяется до i++, чтобы не переполнить i при hi = MaxInt64.
+	prod, exact := int64(1), true
+	fprod := 1.0
+	for i := lo; ; i++ {
+		fprod *= float64(i)
+		if exact {
+			prod, exact = mulInt64(prod, i)
+		}
+		if i == hi {
+			break
+		}
+		if math.IsInf(fprod, 0) {
+			// у отрицательных множителей знак – (-1) в степени их числа hi-lo+1
+			if lo < 0 && (uint64(hi)-uint64(lo))%2 == 0 {
+				return Value{num: math.Inf(-1)}, nil
+			}
+			return Value{num: math.Inf(1)}, nil
+		}
+	}
+	if exact {
+		return intValue(prod), nil
+	}
+	return Value{num: fprod}, nil
+}
+
+// === Разбор инструкций ===
+
+// arrayVariable – переменная-массив с именем name; если переменной нет
+// или она не массив, сообщает об ошибке
+func (in *Interpreter) arrayVariable(name string) (*Variable, bool) {
+	v, ok := in.getVariable(name)
+	if !ok {
+		in.reportError("ОШИБКА: переменная \"%s\" не объявлена", name)
+		return nil, false
+	}
+	if v.kind != KindArray {
+		in.reportError("ОШИБКА: переменная \"%s\" не является массивом", name)
+		return nil, false
+	}
+	return v, true
+}
+
+// Наибольшее число интервалов гистограммы
+const maxHistogramBins = 1000
+
+// histogram – команда "histogram(a, bins)": делит отрезок от наименьшего до
+// наибольшего элемента массива a на bins равных интервалов и выводит для
+// каждого границы, число попавших элементов и столбец из '#'. Интервалы
+// полуоткрытые, кроме последнего, включающего наибольший элемент.
+func (in *Interpreter) histogram(line string) {
+	items := splitTopLevel(line[len("histogram("):len(line)-1], ',')
+	if len(items) != 2 {
+		in.reportError("ОШИБКА: неверный формат команды histogram: %s", line)
+		return
+	}
+	v, ok := in.arrayVariable(strings.TrimSpace(items[0]))
+	if !ok {
+		return
+	}
+	binsVal, ok := in.evaluateExpression(strings.TrimSpace(items[1]))
+	if !ok {
+		return
+	}
+	bins, err := intArg(binsVal)
+	switch {
+	case err != nil:
+		in.reportError("ОШИБКА: histogram: число интервалов должно быть целым: %s", strings.TrimSpace(items[1]))
+		return
+	case bins <= 0 || bins > maxHistogramBins:
+		in.reportError("ОШИБКА: histogram: число интервалов должно быть от 1 до %d, получено %d", maxHistogramBins, bins)
+		return
+	case len(v.elems) == 0:
+		in.reportError("ОШИБКА: histogram: массив \"%s\" пуст", strings.TrimSpace(items[0]))
+		return
+	}
+	if err := numElems(v.elems); err != nil {
+		in.reportError("ОШИБКА: histogram: %v", err)
+		return
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, el := range v.elems {
+		if math.IsNaN(el.num) || math.IsInf(el.num, 0) {
+			in.reportError("ОШИБКА: histogram: элементы массива должны быть конечными числами")
+			return
+		}
+		lo, hi = math.Min(lo, el.num), math.Max(hi, el.num)
+	}
+	width := (hi - lo) / float64(bins)
+	counts := make([]int, bins)
+	for _, el := range v.elems {
+		i := bins - 1
+		if width > 0 && el.num < hi {
+			// из-за округления элемент у правой границы может дать индекс bins
+			if k := int64((el.num - lo) / width); k < i {
+				i = k
+			}
+		}
+		counts[i]++
+	}
+	for i, n := range counts {
+		from, to := lo+width*float64(i), lo+width*float64(i+1)
+		closing := ")"
+		if i == len(counts)-1 {
+			to, closing = hi, "]"
+		}
+		text := fmt.Sprintf("[%g, %g%s %d %s", from, to, closing, n, strings.Repeat("#", n))
+		fmt.Fprintln(in.Out, strings.TrimSpace(text))
+	}
+}
+
+// popArray – удаляет последний элемент массива name и возвращает его
+func (in *Interpreter) popArray(name string) (Value, bool) {
+	v, ok := in.arrayVariable(name)
+	if !ok {
+		return Value{}, false
+	}
+	if len(v.elems) == 0 {
+		in.reportError("ОШИБКА: pop из пустого массива \"%s\"", name)
+		return Value{}, false
+	}
+	last := v.elems[len(v.elems)-1]
+	v.elems = v.elems[:len(v.elems)-1]
+	return last, true
+}
+
+// rename – переименовывает переменную (или, если её нет, функцию) oldName в newName;
+// ошибка, если oldName не существует или имя newName уже занято переменной,
+// функцией, ключевым словом или встроенной функцией
+func (in *Interpreter) rename(oldName, newName string) {
+	v, isVar := in.variables[oldName]
+	fn, isFunc := in.functions[oldName]
+	if !isVar && !isFunc {
+		in.reportError("ОШИБКА: нет переменной или функции \"%s\"", oldName)
+		return
+	}
+	if _, exists := in.variables[newName]; exists {
+		in.reportError("ОШИБКА: переменная \"%s\" уже существует", newName)
+		return
+	}
+	if _, exists := in.functions[newName]; exists {
+		in.reportError("ОШИБКА: функция \"%s\" уже существует", newName)
+		return
+	}
+	if isVar {
+		if !in.checkVariableName(newName) {
+			return
+		}
+		delete(in.variables, oldName)
+		in.variables[newName] = v
+		return
+	}
+	if !in.checkFunctionName(newName) {
+		return
+	}
+	delete(in.functions, oldName)
+	fn.name = newName
+	in.functions[newName] = fn
+}
+
+// reservedWords – ключевые слова инструкций и специальных форм; они, как и
+// имена встроенных функций, не могут быть именами переменных
+var reservedWords = map[string]bool{
+	"print": true, "echo": true, "show": true, "printhex": true, "printoct": true, "printbin": true,
+	"debug": true, "functions": true, "memoize": true, "input": true, "let": true, "mod": true, "probe": true, "histogram": true,
+	"clear": true, "reset": true, "include": true, "writeto": true, "rename": true,
+	"repeat": true, "while": true, "do": true, "for": true,
+	"break": true, "continue": true,
+	"push": true, "pop": true, "reverse": true, "sort": true, "desc": true,
+	"assert": true, "assert_close": true, "assert_error": true,
+	"defined": true, "map": true, "lambda": true,
+}
+
+// isIdentifier – имя из букв, цифр и '_', не начинающееся с цифры
+func isIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkVariableName – проверяет, что name может быть именем переменной:
+// это идентификатор, не совпадающий с ключевым словом или встроенной функцией
+func (in *Interpreter) checkVariableName(name string) bool {
+	switch {
+	case !isIdentifier(name):
+		in.reportError("ОШИБКА: недопустимое имя переменной \"%s\"", name)
+		return false
+	case reservedWords[name]:
+		in.reportError("ОШИБКА: \"%s\" – зарезервированное слово и не может быть именем переменной", name)
+		return false
+	case builtins[name] != nil:
+		in.reportError("ОШИБКА: \"%s\" – встроенная функция и не может быть именем переменной", name)
+		return false
+	}
+	return true
+}
+
+// checkFunctionName – проверяет, что name может быть именем функции: это
+// идентификатор, не совпадающий с ключевым словом; встроенные функции вызываются
+// раньше пользовательских, поэтому одноимённая функция была бы недоступна
+func (in *Interpreter) checkFunctionName(name string) bool {
+	switch {
+	case !isIdentifier(name):
+		in.reportError("ОШИБКА: недопустимое имя функции \"%s\"", name)
+		return false
+	case reservedWords[name]:
+		in.reportError("ОШИБКА: \"%s\" – зарезервированное слово и не может быть именем функции", name)
+		return false
+	case builtins[name] != nil:
+		in.reportError("ОШИБКА: \"%s\" – встроенная функция и не может быть переопределена", name)
+		return false
+	}
+	return true
+}
+
+// assignVariable – обычное присваивание varName=val.
+// Если переменная уже объявлена, берём её тип, иначе выводим из типа значения.
+func (in *Interpreter) assignVariable(varName string, val Value) {
+	if !in.checkVariableName(varName) {
+		return
+	}
+	v, found := in.getVariable(varName)
+	if found && v.kind != val.kind {
+		in.reportError("ОШИБКА: переменной \"%s\" (%s) нельзя присвоить значение типа %s",
+			varName, typeName(v.get()), typeName(val))
+		return
+	}
+	if val.kind != KindNumber {
+		// массив присваивается копией, строка и функция – целиком
+		if !in.checkVariableLimit(varName) {
+			return
+		}
+		in.variables[varName] = newVariable(val)
+		return
+	}
+	if found {
+		// сохраняем значение с учётом её типа
+		if !v.set(val) {
+			in.reportError("ОШИБКА: число слишком большое для целой переменной %s: %g", varName, val.num)
+		}
+	} else {
+		// Тип – из результата вычисления (целые литералы, переменные и операции над ними дают int)
+		in.setVariable(varName, val.isInt, val)
+	}
+}
+
+// Форматы вывода целых чисел для команд print<суффикс>
+var radixFormats = []struct {
+	suffix string // суффикс команды: printhex, printoct, printbin
+	verb   string // формат для fmt
+}{
+	{"hex", "%#x"},
+	{"oct", "%O"},
+	{"bin", "%#b"},
+}
+
+// decimalCommas – заменяет десятичную запятую на точку в числовых литералах
+// (режим --locale ru). Запятая считается десятичной, только если она стоит
+// вплотную между цифрами числа: "3,14" – число 3.14, а "max(3, 14)" и
+// "max(3 ,14)" – два аргумента. Цифры в конце имени ("x1,2") числом не считаются.
+func decimalCommas(line string) string {
+	// позиции ищем в строке со скрытыми строковыми литералами: "1,5" в кавычках – текст, а не число
+	masked := maskStrings(line)
+	b := []byte(line)
+	for i := 1; i+1 < len(masked); i++ {
+		if masked[i] != ',' || !unicode.IsDigit(rune(masked[i-1])) || !unicode.IsDigit(rune(masked[i+1])) {
+			continue
+		}
+		// начало последовательности цифр перед запятой
+		j := i - 1
+		for j > 0 && unicode.IsDigit(rune(masked[j-1])) {
+			j--
+		}
+		if prev, _ := utf8.DecodeLastRuneInString(masked[:j]); j > 0 && (unicode.IsLetter(prev) || prev == '_' || prev == '.') {
+			continue
+		}
+		b[i] = '.'
+	}
+	return string(b)
+}
+
+// stripComment – строка без комментария: всё после '#' (вне строковых литералов)
+func stripComment(line string) string {
+	if idx := strings.IndexByte(maskStrings(line), '#'); idx != -1 {
+		return line[:idx]
+	}
+	return line
+}
+
+// maskStrings – копия s, в которой содержимое строковых литералов "..."
+// заменено на '_' (байт в байт), чтобы запятые, скобки, ':' и '=' внутри строк
+// не мешали разбору структуры инструкции; позиции символов не меняются
+func maskStrings(s string) string {
+	b := []byte(s)
+	inString := false
+	for i := 0; i < len(b); i++ {
+		switch {
+		case b[i] == '"':
+			inString = !inString
+		case inString && b[i] == '\\' && i+1 < len(b):
+			b[i], b[i+1] = '_', '_'
+			i++
+		case inString:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// splitTopLevel – делит строку по разделителю sep, не заходя внутрь скобок
+// (круглых и квадратных) и строк: "a, f(b, c), [1, 2]" -> "a", " f(b, c)", " [1, 2]"
+func splitTopLevel(s string, sep rune) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range maskStrings(s) {
+		switch r {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+		case sep:
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + len(string(sep))
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// colonAssign – присваивание ":=" – однозначная форма: в правой части одиночный
+// '=' – сравнение ("x := x = 5" присваивает x значение 1 или 0). Инструкция
+// сводится к обычному присваиванию "x = x == 5"; другие строки не меняются.
+func colonAssign(line string) string {
+	if left, right, ok := strings.Cut(line, ":="); ok && isIdentifier(strings.TrimSpace(left)) {
+		return strings.TrimSpace(left) + " = " + equalities(strings.TrimSpace(right))
+	}
+	return line
+}
+
+// equalities – выражение, в котором одиночные '=' (не в составе ==, !=, <=, >=
+// и не внутри строк) заменены на "==": правая часть присваивания ":="
+func equalities(expr string) string {
+	masked := maskStrings(expr)
+	var b strings.Builder
+	for i := 0; i < len(expr); i++ {
+		b.WriteByte(expr[i])
+		if masked[i] != '=' {
+			continue
+		}
+		if i+1 < len(masked) && masked[i+1] == '=' {
+			b.WriteByte('=')
+			i++ // уже "=="
+			continue
+		}
+		if i == 0 || !strings.ContainsRune("<>!", rune(masked[i-1])) {
+			b.WriteByte('=')
+		}
+	}
+	return b.String()
+}
+
+// findAssign – позиция знака присваивания '=' в инструкции или -1.
+// Знаки '=' в составе операторов ==, !=, <=, >= присваиванием не считаются,
+// как и '=' внутри скобок (в режиме --eq-compat это сравнение).
+func findAssign(line string) int {
+	line = maskStrings(line)
+	depth := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+		}
+		if line[i] != '=' || depth > 0 {
+			continue
+		}
+		if i+1 < len(line) && line[i+1] == '=' {
+			i++ // пропускаем "=="
+			continue
+		}
+		if i > 0 && strings.ContainsRune("<>!", rune(line[i-1])) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// runBody – однократное выполнение тела цикла в собственной области видимости:
+// переменные, объявленные в нём через let, после выполнения удаляются
+// (или возвращают значения, которые имели до объявления)
+func (in *Interpreter) runBody(body string) flow {
+	in.scopes = append(in.scopes, nil)
+	defer func() {
+		scope := in.scopes[len(in.scopes)-1]
+		in.scopes = in.scopes[:len(in.scopes)-1]
+		for name, outer := range scope {
+			delete(in.variables, name)
+			if outer != nil {
+				in.variables[name] = outer
+			}
+		}
+	}()
+	return in.processLine(body)
+}
+
+// letVariable – команда "let name = выражение": в теле цикла объявляет переменную,
+// видимую только до конца тела (внешняя переменная с тем же именем на это время
+// скрывается); вне циклов – обычное присваивание глобальной переменной
+func (in *Interpreter) letVariable(decl string) {
+	eq := findAssign(decl)
+	if eq == -1 {
+		in.reportError("ОШИБКА: неверный формат объявления let: %s", decl)
+		return
+	}
+	varName := strings.TrimSpace(decl[:eq])
+	if !in.checkVariableName(varName) {
+		return
+	}
+	val, ok := in.evaluateExpression(strings.TrimSpace(decl[eq+1:]))
+	if !ok {
+		return
+	}
+	if n := len(in.scopes); n > 0 {
+		if in.scopes[n-1] == nil {
+			in.scopes[n-1] = make(map[string]*Variable)
+		}
+		scope := in.scopes[n-1]
+		if _, declared := scope[varName]; !declared {
+			// новая переменная: тип выводится из значения, а не берётся у внешней
+			scope[varName] = in.variables[varName]
+			delete(in.variables, varName)
+		}
+	}
+	in.assignVariable(varName, val)
+}
+
+// loopCondition – значение условия цикла: истина, если число не равно нулю
+func (in *Interpreter) loopCondition(cond string) (bool, bool) {
+	val, ok := in.evaluateExpression(cond)
+	if !ok {
+		return false, false
+	}
+	if val.kind != KindNumber {
+		in.reportError("ОШИБКА: условие цикла должно быть числом: %s", cond)
+		return false, false
+	}
+	return val.num != 0, true
+}
+
+// runLoop – выполняет body, пока условие cond истинно; при bodyFirst тело
+// выполняется до первой проверки условия (цикл do ... while)
+func (in *Interpreter) runLoop(cond, body string, bodyFirst bool) {
+	if in.astOnly {
+		// --ast: условие и тело выводятся по одному разу
+		in.loopCondition(cond)
+		in.runBody(body)
+		return
+	}
+	for i := 0; ; i++ {
+		if !bodyFirst || i > 0 {
+			holds, ok := in.loopCondition(cond)
+			if !ok || !holds {
+				return
+			}
+		}
+		if i >= in.maxIterations {
+			in.reportError("ОШИБКА: цикл превысил ограничение %d итераций (флаг --max-iterations)", in.maxIterations)
+			return
+		}
+		in.checkRuntime()
+		if in.runBody(body) == flowBreak {
+			return
+		}
+	}
+}
+
+// forLoop – цикл "for i in lo..hi do инструкция": i – целая переменная, принимающая
+// значения от lo до hi включительно; при lo > hi счёт идёт вниз (5..0 – 5, 4, ..., 0).
+// Границы – целые выражения, число итераций ограничено --max-iterations.
+func (in *Interpreter) forLoop(line string) {
+	head, body, found := strings.Cut(line[len("for"):], " do ")
+	varName, rng, hasIn := strings.Cut(strings.TrimSpace(head), " in ")
+	lo, hi, hasRange := strings.Cut(rng, "..")
+	if !found || !hasIn || !hasRange {
+		in.reportError("ОШИБКА: неверный формат цикла for: %s", line)
+		return
+	}
+	varName = strings.TrimSpace(varName)
+	body = strings.TrimSpace(body)
+	if !in.checkVariableName(varName) {
+		return
+	}
+	loVal, loOK := in.evaluateExpression(strings.TrimSpace(lo))
+	hiVal, hiOK := in.evaluateExpression(strings.TrimSpace(hi))
+	if in.astOnly {
+		in.runBody(body)
+		return
+	}
+	if !loOK || !hiOK {
+		return
+	}
+	from, errLo := intArg(loVal)
+	to, errHi := intArg(hiVal)
+	if errLo != nil || errHi != nil {
+		in.reportError("ОШИБКА: границы цикла for должны быть целыми числами: %s", strings.TrimSpace(rng))
+		return
+	}
+	step, n, ok := int64(1), int64(0), true
+	if from <= to {
+		n, ok = subInt64(to, from)
+	} else {
+		step = -1
+		n, ok = subInt64(from, to)
+	}
+	if !ok || n >= int64(in.maxIterations) {
+		in.reportError("ОШИБКА: диапазон %d..%d превышает ограничение %d итераций (флаг --max-iterations)",
+			from, to, in.maxIterations)
+		return
+	}
+	if !in.checkVariableLimit(varName) {
+		return
+	}
+	for i := from; ; i += step {
+		in.checkRuntime()
+		in.variables[varName] = newVariable(intValue(i))
+		if in.runBody(body) == flowBreak || i == to {
+			return
+		}
+	}
+}
+
+// parseFunctionDef – разбирает определение функции "name(param1, param2, ...): выражение"
+// (или лямбды "lambda(x): выражение") на имя, параметры и тело. Сообщает об ошибке
+// и возвращает ok = false при неверном формате.
+func (in *Interpreter) parseFunctionDef(line string) (funcName string, params []Param, right string, ok bool) {
+	// Пример: foo(x, y): (x*y+2)...
+	idxCloseParen := strings.Index(maskStrings(line), ")")
+	after := ""
+	if idxCloseParen != -1 {
+		after = strings.TrimSpace(line[idxCloseParen+1:])
+	}
+	if !strings.HasPrefix(after, ":") {
+		in.reportError("ОШИБКА: неверный формат определения функции: %s", line)
+		return
+	}
+	left := strings.TrimSpace(line[:idxCloseParen+1]) // foo(x, y)
+	right = strings.TrimSpace(after[1:])              // (x*y+2)...
+	// тело в фигурных скобках; в файле оно может занимать несколько строк (см. nextStatement)
+	if strings.HasPrefix(right, "{") && strings.HasSuffix(right, "}") {
+		right = strings.TrimSpace(right[1 : len(right)-1])
+	}
+
+	// Разберём left, чтобы извлечь имя функции и параметры
+	// Формат:  functionName(param1, param2, ...)
+	idxOpenParen := strings.Index(left, "(")
+	idxCloseParen = len(left) - 1
+	if idxOpenParen == -1 {
+		in.reportError("ОШИБКА: неверный формат определения функции: %s", line)
+		return
+	}
+	funcName = strings.TrimSpace(left[:idxOpenParen])
+	paramsStr := left[idxOpenParen+1 : idxCloseParen]
+	paramsStr = strings.TrimSpace(paramsStr)
+	// Пустой список "()" – функция без параметров, вызывается как name()
+	if paramsStr != "" {
+		arr := strings.Split(paramsStr, ",")
+		for _, p := range arr {
+			p = strings.TrimSpace(p)
+			if p == "" {
+				// например, "f(x,)" или "f(,x)"
+				in.reportError("ОШИБКА: пустое имя параметра в определении функции: %s", line)
+				return
+			}
+			// необязательный тип параметра: "x:i" или "x:f"
+			param := Param{name: p}
+			if idx := strings.Index(p, ":"); idx != -1 {
+				param.name = strings.TrimSpace(p[:idx])
+				param.typ = strings.TrimSpace(p[idx+1:])
+				if param.typ != "i" && param.typ != "f" {
+					in.reportError("ОШИБКА: неизвестный тип параметра %s: %s", param.name, param.typ)
+					return
+				}
+			}
+			// параметр на время вызова становится переменной (см. callFunction),
+			// поэтому к его имени те же требования, что и к имени переменной
+			if !in.checkVariableName(param.name) {
+				return
+			}
+			for _, prev := range params {
+				if prev.name == param.name {
+					in.reportError("ОШИБКА: параметр %s повторяется в определении функции: %s", param.name, line)
+					return
+				}
+			}
+			params = append(params, param)
+		}
+	}
+	return funcName, params, right, true
+}
+
+// flow – чем закончилось выполнение инструкции: обычным образом или командой
+// break/continue, которую обрабатывает ближайший объемлющий цикл
+type flow int
+
+const (
+	flowNext     flow = iota // перейти к следующей инструкции
+	flowBreak                // break: выйти из цикла
+	flowContinue             // continue: перейти к следующей итерации цикла
+)
+
+// assertError – проверка "assert_error инструкция": инструкция (или выражение,
+// например "1/0" или "f()") должна завершиться ошибкой. Ожидаемая ошибка не
+// выводится и не влияет на код выхода; успешное выполнение – проваленная проверка.
+func (in *Interpreter) assertError(stmt string) {
+	errorsBefore, errOut := in.errorCount, in.Err
+	func() {
+		// вывод ошибок восстанавливается и при прерывании по --max-runtime
+		in.Err = io.Discard
+		defer func() { in.Err = errOut }()
+		if _, err := in.parseExpr(stmt, true); err == nil {
+			in.evaluateResults(stmt)
+		} else {
+			in.processLine(stmt)
+		}
+	}()
+	if in.astOnly {
+		return // --ast: инструкция только выведена в виде дерева
+	}
+	if in.errorCount > errorsBefore {
+		in.errorCount = errorsBefore
+		return
+	}
+	in.reportError("ОШИБКА: проверка не выполнена: ожидалась ошибка: %s", stmt)
+}
+
+// trimStatement – текст инструкции без комментария, пробелов по краям и
+// завершающих ';' (каждая инструкция заканчивается точкой с запятой; лишние
+// ";;" допустимы). Пустой результат – пустая инструкция, которая ничего не делает.
+func trimStatement(line string) string {
+	return strings.TrimRight(strings.TrimSpace(stripComment(line)), "; \t")
+}
+
+// runStatement – выполняет инструкцию верхнего уровня (строку файла или
+// интерактивного режима): break и continue вне цикла – ошибка
+func (in *Interpreter) runStatement(line string) {
+	errorsBefore := in.errorCount
+	switch in.processLine(line) {
+	case flowBreak:
+		in.reportError("ОШИБКА: break вне цикла")
+	case flowContinue:
+		in.reportError("ОШИБКА: continue вне цикла")
+	}
+	// --stats: инструкция с ошибкой – та, во время которой сообщено хотя бы об одной ошибке
+	if in.statsEnabled && trimStatement(line) != "" {
+		in.stats.statements++
+		if in.errorCount > errorsBefore {
+			in.stats.failedStatements++
+		}
+	}
+}
+
+// parseNumber – число из текста: целое, если записано без дробной части и
+// помещается в int64, иначе вещественное
+func parseNumber(text string) (Value, bool) {
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return intValue(n), true
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return Value{num: f}, true
+	}
+	return Value{}, false
+}
+
+// readInput – команда input: target – имя переменной, возможно с типом "x(i)"
+// или "x(f)". Без типа целое число во вводе даёт целую переменную, иначе – вещественную.
+func (in *Interpreter) readInput(target string) {
+	varName, typeChar := target, ""
+	if idx := strings.Index(target, "("); idx != -1 && strings.HasSuffix(target, ")") {
+		varName = strings.TrimSpace(target[:idx])
+		typeChar = strings.TrimSpace(target[idx+1 : len(target)-1])
+		if typeChar != "i" && typeChar != "f" {
+			in.reportError("ОШИБКА: неизвестный тип переменной: %s", typeChar)
+			return
+		}
+	}
+	if !in.checkVariableName(varName) {
+		return
+	}
+	text, ok := in.readLine()
+	if !ok {
+		in.reportError("ОШИБКА: нет входных данных для переменной %s", varName)
+		return
+	}
+	text = strings.TrimSpace(text)
+	if in.decimalComma {
+		text = strings.Replace(text, ",", ".", 1)
+	}
+	val, ok := parseNumber(text)
+	if !ok {
+		in.reportError("ОШИБКА: неверное число во вводе для переменной %s: %q", varName, text)
+		return
+	}
+	in.setVariable(varName, typeChar == "i" || typeChar == "" && val.isInt, val)
+}
+
+// trace – в режиме --verbose сообщает, к какому виду отнесена инструкция
+func (in *Interpreter) trace(kind, line string) {
+	if in.verbose {
+		fmt.Fprintf(in.Err, "[%s] %s\n", kind, line)
+	}
+}
+
+// processLine – выполняет одну инструкцию. Результат – сигнал для объемлющего
+// цикла: flowBreak и flowContinue возвращают команды break и continue.
+func (in *Interpreter) processLine(line string) flow {
+	line = trimStatement(line)
+	if line == "" {
+		// пустая инструкция: пустая строка, только комментарий, ";" или ";;"
+		return flowNext
+	}
+	if in.decimalComma {
+		line = decimalCommas(line)
+	}
+
+	// break и continue – сигнал ближайшему объемлющему циклу (см. flow)
+	if line == "break" {
+		in.trace("break", line)
+		return flowBreak
+	}
+	if line == "continue" {
+		in.trace("continue", line)
+		return flowContinue
+	}
+
+	line = colonAssign(line)
+
+	// 0) Вывод целой переменной в другой системе счисления:
+	//    "printhex x;", "printoct x;", "printbin x;" (суффикс команды выбирает формат)
+	for _, rf := range radixFormats {
+		cmd := "print" + rf.suffix
+		if line == cmd || strings.HasPrefix(line, cmd+" ") {
+			in.trace("radix-print", line)
+			varName := strings.TrimSpace(line[len(cmd):])
+			v, ok := in.getVariable(varName)
+			if !ok {
+				in.reportError("ОШИБКА: переменная \"%s\" не объявлена", varName)
+			} else if v.kind != KindNumber || !v.isInt {
+				in.reportError("ОШИБКА: команда %s применима только к целым переменным, \"%s\" – %s",
+					cmd, varName, typeName(v.get()))
+			} else {
+				in.printResult(fmt.Sprintf("%s = "+rf.verb+" (int)", varName, v.ival))
+			}
+			return flowNext
+		}
+	}
+
+	// 1) Проверим, не print ли это
+	//    - "print;", "print varName;" или "print expr1, expr2, ...;"
+	if line == "print" || strings.HasPrefix(line, "print ") {
+		in.trace("print", line)
+		rest := strings.TrimSpace(line[len("print"):])
+		// необязательная ширина поля: "print x : 8" выравнивает значения
+		// по правому краю в 8 позициях, "print x : -8" – по левому
+		width := 0
+		if idx := strings.LastIndex(maskStrings(rest), ":"); idx != -1 {
+			w, err := strconv.Atoi(strings.TrimSpace(rest[idx+1:]))
+			if err != nil {
+				in.reportError("ОШИБКА: неверная ширина поля в print: %s", strings.TrimSpace(rest[idx+1:]))
+				return flowNext
+			}
+			width = w
+			rest = strings.TrimSpace(rest[:idx])
+		}
+		if rest != "" && in.astOnly {
+			for _, item := range splitTopLevel(rest, ',') {
+				in.dumpAST(strings.TrimSpace(item), false)
+			}
+		} else if rest == "" && in.jsonOutput {
+			// все переменные – одним JSON-массивом, по алфавиту
+			names := make([]string, 0, len(in.variables))
+			for name := range in.variables {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			records := make([]jsonRecord, len(names))
+			for i, name := range names {
+				val := in.variables[name].get()
+				records[i] = jsonRecord{Name: name, Type: typeName(val), Value: jsonValue(val)}
+			}
+			in.writeJSON(records)
+		} else if rest == "" {
+			// вывести все переменные
+			fmt.Fprintln(in.Out, "== Список всех переменных ==")
+			for name, v := range in.variables {
+				in.printVariable(name, v, width)
+			}
+		} else if items := splitTopLevel(rest, ','); len(items) > 1 || !isIdentifier(rest) {
+			// print a, a+1, b: значения выражений в одну строку через разделитель;
+			// так же выводится одно выражение, не являющееся именем: print a + 1
+			// (а "print =x" – ошибка разбора выражения)
+			parts := make([]string, len(items))
+			records := make([]jsonRecord, len(items))
+			for i, item := range items {
+				item = strings.TrimSpace(item)
+				val, ok := in.evaluateExpression(item)
+				if !ok {
+					return flowNext
+				}
+				parts[i] = padValue(in.printValue(val), width)
+				records[i] = jsonRecord{Expr: item, Type: typeName(val), Value: jsonValue(val)}
+			}
+			if in.jsonOutput {
+				in.writeJSON(records)
+			} else {
+				in.printResult(strings.Join(parts, in.printSep))
+			}
+		} else {
+			// print varName
+			varName := rest
+			if v, ok := in.getVariable(varName); ok {
+				in.printVariable(varName, v, width)
+			} else {
+				in.reportError("ОШИБКА: переменная \"%s\" не объявлена", varName)
+			}
+		}
+		return flowNext
+	}
+
+	// "echo выражение" – только значение выражения, без имени и типа (как калькулятор);
+	// в отличие от print, имя переменной здесь – просто выражение
+	if strings.HasPrefix(line, "echo ") {
+		in.trace("echo", line)
+		if val, ok := in.evaluateExpression(strings.TrimSpace(line[len("echo"):])); ok {
+			in.printResult(in.printValue(val))
+		}
+		return flowNext
+	}
+
+	// "probe f(2, 3)" – вызов функции с выводом аргументов и результата (см. probe)
+	if strings.HasPrefix(line, "probe ") {
+		in.trace("probe", line)
+		in.probe(strings.TrimSpace(line[len("probe"):]))
+		return flowNext
+	}
+
+	// "show выражение" – исходный текст выражения и его значение: "x + 2 = 7"
+	if strings.HasPrefix(line, "show ") {
+		in.trace("show", line)
+		expr := strings.TrimSpace(line[len("show"):])
+		if val, ok := in.evaluateExpression(expr); ok {
+			in.printResult(fmt.Sprintf("%s = %s", expr, in.printValue(val)))
+		}
+		return flowNext
+	}
+
+	// "let t = выражение" – переменная, локальная для тела цикла (см. letVariable)
+	if strings.HasPrefix(line, "let ") {
+		in.trace("let", line)
+		in.letVariable(strings.TrimSpace(line[len("let"):]))
+		return flowNext
+	}
+
+	// "input x" – число из строки ввода; "input x(i)" и "input x(f)" приводят
+	// его к целому (с отбрасыванием дробной части) или вещественному, как x(i)=...
+	if strings.HasPrefix(line, "input ") {
+		in.trace("input", line)
+		in.readInput(strings.TrimSpace(line[len("input"):]))
+		return flowNext
+	}
+
+	// Цикл "repeat N do инструкция": тело выполняется N раз; N – выражение,
+	// дробная часть отбрасывается, отрицательное N – ошибка
+	if strings.HasPrefix(line, "repeat ") {
+		in.trace("repeat", line)
+		idx := strings.Index(line, " do ")
+		if idx == -1 {
+			in.reportError("ОШИБКА: неверный формат цикла repeat: %s", line)
+			return flowNext
+		}
+		countExpr := strings.TrimSpace(line[len("repeat"):idx])
+		body := strings.TrimSpace(line[idx+len(" do "):])
+		val, ok := in.evaluateExpression(countExpr)
+		if in.astOnly {
+			in.runBody(body)
+			return flowNext
+		}
+		if !ok {
+			return flowNext
+		}
+		if val.kind != KindNumber {
+			in.reportError("ОШИБКА: число повторений должно быть числом: %s", countExpr)
+			return flowNext
+		}
+		if val.num < 0 {
+			in.reportError("ОШИБКА: отрицательное число повторений: %g", val.num)
+			return flowNext
+		}
+		if val.num > float64(in.maxIterations) {
+			in.reportError("ОШИБКА: число повторений %g превышает ограничение %d (флаг --max-iterations)",
+				val.num, in.maxIterations)
+			return flowNext
+		}
+		for i := 0; i < int(val.num); i++ {
+			in.checkRuntime()
+			if in.runBody(body) == flowBreak {
+				break
+			}
+		}
+		return flowNext
+	}
+
+	// Циклы с условием: "while (cond) do инструкция" проверяет условие перед
+	// каждым выполнением тела, "do инструкция while (cond)" – после, поэтому тело
+	// выполняется хотя бы один раз. Число итераций ограничено --max-iterations.
+	if strings.HasPrefix(line, "while ") {
+		in.trace("while", line)
+		idx := strings.Index(maskStrings(line), " do ")
+		if idx == -1 {
+			in.reportError("ОШИБКА: неверный формат цикла while: %s", line)
+			return flowNext
+		}
+		cond := strings.TrimSpace(line[len("while"):idx])
+		body := strings.TrimSpace(line[idx+len(" do "):])
+		in.runLoop(cond, body, false)
+		return flowNext
+	}
+	if strings.HasPrefix(line, "do ") {
+		in.trace("do-while", line)
+		idx := strings.LastIndex(maskStrings(line), " while ")
+		if idx == -1 {
+			in.reportError("ОШИБКА: неверный формат цикла do ... while: %s", line)
+			return flowNext
+		}
+		body := strings.TrimSpace(line[len("do"):idx])
+		cond := strings.TrimSpace(line[idx+len(" while "):])
+		in.runLoop(cond, body, true)
+		return flowNext
+	}
+
+	// Цикл по диапазону целых: "for i in 0..5 do инструкция"
+	if strings.HasPrefix(line, "for ") {
+		in.trace("for", line)
+		in.forLoop(line)
+		return flowNext
+	}
+
+	// Подключение файла: include "lib.calc" – инструкции файла выполняются
+	// в текущем состоянии; относительный путь считается от каталога текущего файла
+	if strings.HasPrefix(line, "include ") {
+		in.trace("include", line)
+		path := strings.TrimSpace(line[len("include"):])
+		if len(path) < 2 || path[0] != '"' || path[len(path)-1] != '"' {
+			in.reportError("ОШИБКА: неверный формат команды include: %s", line)
+			return flowNext
+		}
+		path = path[1 : len(path)-1]
+		if !filepath.IsAbs(path) && len(in.files) > 0 {
+			path = filepath.Join(filepath.Dir(in.files[len(in.files)-1]), path)
+		}
+		if err := in.processFile(path); err != nil {
+			in.reportError("ОШИБКА: include: %v", err)
+		}
+		return flowNext
+	}
+
+	// Перенаправление вывода: writeto "out.txt" – дальнейший вывод print идёт
+	// в файл, "writeto" без аргумента возвращает прежний вывод
+	if line == "writeto" || strings.HasPrefix(line, "writeto ") {
+		in.trace("writeto", line)
+		path := strings.TrimSpace(line[len("writeto"):])
+		if path == "" {
+			if err := in.restoreOutput(); err != nil {
+				in.reportError("ОШИБКА: writeto: %v", err)
+			}
+			return flowNext
+		}
+		if len(path) < 2 || path[0] != '"' || path[len(path)-1] != '"' {
+			in.reportError("ОШИБКА: неверный формат команды writeto: %s", line)
+			return flowNext
+		}
+		if err := in.redirectOutput(path[1 : len(path)-1]); err != nil {
+			in.reportError("ОШИБКА: writeto: %v", err)
+		}
+		return flowNext
+	}
+
+	// Переименование: "rename old new" – переменная или функция old получает имя new.
+	// Если old – и переменная, и функция, переименовывается переменная.
+	if strings.HasPrefix(line, "rename ") {
+		in.trace("rename", line)
+		names := strings.Fields(line[len("rename"):])
+		if len(names) != 2 {
+			in.reportError("ОШИБКА: неверный формат команды rename: %s", line)
+			return flowNext
+		}
+		in.rename(names[0], names[1])
+		return flowNext
+	}
+
+	// Список объявленных функций: "functions"
+	if line == "functions" {
+		in.trace("functions", line)
+		in.printFunctions()
+		return flowNext
+	}
+
+	// Сброс состояния: "clear functions" удаляет все функции, "clear vars" – все
+	// переменные (в том числе хранящие лямбды), "reset" – и то, и другое
+	if line == "clear functions" || line == "clear vars" || line == "reset" {
+		in.trace("clear", line)
+		switch line {
+		case "clear functions":
+			in.functions = make(map[string]*Function)
+		case "clear vars":
+			in.variables = make(map[string]*Variable)
+		default:
+			in.Reset()
+		}
+		return flowNext
+	}
+
+	// "memoize f" – результаты функции f кэшируются по значениям аргументов
+	// (для чистых функций: тело не должно зависеть от глобальных переменных)
+	if strings.HasPrefix(line, "memoize ") {
+		in.trace("memoize", line)
+		name := strings.TrimSpace(line[len("memoize"):])
+		fn, ok := in.getFunction(name)
+		if !ok {
+			in.reportError("ОШИБКА: функция \"%s\" не объявлена", name)
+			return flowNext
+		}
+		if fn.memo == nil {
+			fn.memo = make(map[string][]Value)
+		}
+		return flowNext
+	}
+
+	// Отладочная команда "debug varName": происхождение переменной, её тип и значение
+	if strings.HasPrefix(line, "debug ") {
+		in.trace("debug", line)
+		varName := strings.TrimSpace(line[len("debug"):])
+		origin, v := in.variableOrigin(varName)
+		if v == nil {
+			fmt.Fprintf(in.Out, "%s: %s\n", varName, origin)
+		} else {
+			fmt.Fprintf(in.Out, "%s: %s, %s = %s\n", varName, origin, typeName(v.get()), formatValue(v.get()))
+		}
+		return flowNext
+	}
+
+	// Перестановка элементов массива на месте: "reverse(a)", "sort(a)", "sort(a, desc)"
+	if (strings.HasPrefix(line, "reverse(") || strings.HasPrefix(line, "sort(")) && strings.HasSuffix(line, ")") {
+		in.trace("reorder", line)
+		idx := strings.Index(line, "(")
+		cmd := line[:idx]
+		args := strings.Split(line[idx+1:len(line)-1], ",")
+		desc := false
+		if cmd == "sort" && len(args) == 2 && strings.TrimSpace(args[1]) == "desc" {
+			desc = true
+			args = args[:1]
+		}
+		if len(args) != 1 {
+			in.reportError("ОШИБКА: неверный формат команды %s: %s", cmd, line)
+			return flowNext
+		}
+		v, ok := in.arrayVariable(strings.TrimSpace(args[0]))
+		if !ok {
+			return flowNext
+		}
+		if cmd == "reverse" {
+			for i, j := 0, len(v.elems)-1; i < j; i, j = i+1, j-1 {
+				v.elems[i], v.elems[j] = v.elems[j], v.elems[i]
+			}
+		} else {
+			if err := numElems(v.elems); err != nil {
+				in.reportError("ОШИБКА: sort: %v", err)
+				return flowNext
+			}
+			sort.SliceStable(v.elems, func(i, j int) bool {
+				if desc {
+					return v.elems[i].num > v.elems[j].num
+				}
+				return v.elems[i].num < v.elems[j].num
+			})
+		}
+		return flowNext
+	}
+
+	// Гистограмма распределения элементов массива: "histogram(a, 5)"
+	if strings.HasPrefix(line, "histogram(") && strings.HasSuffix(line, ")") {
+		in.trace("histogram", line)
+		in.histogram(line)
+		return flowNext
+	}
+
+	// Изменение длины массива: "push a, expr" добавляет значение в конец,
+	// "pop a" удаляет последний элемент (его можно присвоить: "x = pop a")
+	if strings.HasPrefix(line, "push ") {
+		in.trace("push", line)
+		items := splitTopLevel(strings.TrimSpace(line[len("push"):]), ',')
+		if len(items) != 2 {
+			in.reportError("ОШИБКА: неверный формат команды push: %s", line)
+			return flowNext
+		}
+		v, ok := in.arrayVariable(strings.TrimSpace(items[0]))
+		if !ok {
+			return flowNext
+		}
+		val, ok := in.evaluateExpression(strings.TrimSpace(items[1]))
+		if !ok {
+			return flowNext
+		}
+		if val.kind != KindNumber {
+			in.reportError("ОШИБКА: элементы массива должны быть числами: %s", line)
+			return flowNext
+		}
+		v.elems = append(v.elems, val)
+		return flowNext
+	}
+	if strings.HasPrefix(line, "pop ") {
+		in.trace("pop", line)
+		in.popArray(strings.TrimSpace(line[len("pop"):]))
+		return flowNext
+	}
+
+	// Проверки для тестовых файлов: "assert expr" (выражение должно быть ненулевым)
+	// и "assert_close(a, b, eps)" (|a - b| <= eps). Проваленная проверка
+	// считается ошибкой и влияет на код выхода.
+	if strings.HasPrefix(line, "assert ") {
+		in.trace("assert", line)
+		expr := strings.TrimSpace(line[len("assert"):])
+		val, ok := in.evaluateExpression(expr)
+		if !ok {
+			return flowNext
+		}
+		if val.kind != KindNumber {
+			in.reportError("ОШИБКА: assert ожидает число, получено %s: %s", typeName(val), expr)
+		} else if val.num == 0 {
+			in.reportError("ОШИБКА: проверка не выполнена: %s", expr)
+		}
+		return flowNext
+	}
+	if strings.HasPrefix(line, "assert_error ") {
+		in.trace("assert", line)
+		in.assertError(strings.TrimSpace(line[len("assert_error"):]))
+		return flowNext
+	}
+	if strings.HasPrefix(line, "assert_close(") && strings.HasSuffix(line, ")") {
+		in.trace("assert", line)
+		items := splitTopLevel(line[len("assert_close("):len(line)-1], ',')
+		arity := Builtin{minArgs: 3, maxArgs: 3}
+		if msg := arity.checkArity("assert_close", len(items)); msg != "" {
+			in.reportError("ОШИБКА: %s", msg)
+			return flowNext
+		}
+		vals := make([]float64, len(items))
+		for i, item := range items {
+			val, ok := in.evaluateExpression(strings.TrimSpace(item))
+			if !ok {
+				return flowNext
+			}
+			if val.kind != KindNumber {
+				in.reportError("ОШИБКА: assert_close ожидает числа, получено %s: %s", typeName(val), strings.TrimSpace(item))
+				return flowNext
+			}
+			vals[i] = val.num
+		}
+		a, b, eps := vals[0], vals[1], vals[2]
+		if eps < 0 {
+			in.reportError("ОШИБКА: assert_close: допуск не может быть отрицательным: %g", eps)
+		} else if diff := math.Abs(a - b); !(diff <= eps) {
+			in.reportError("ОШИБКА: проверка не выполнена: %s (|%g - %g| = %g > %g)", line, a, b, diff, eps)
+		}
+		return flowNext
+	}
+
+	// Лямбда: "sq = lambda(x): x*x" – функция как значение переменной; её можно
+	// вызвать как sq(3) и передать в map или в другую функцию
+	if eq := findAssign(line); eq != -1 && strings.HasPrefix(strings.TrimSpace(line[eq+1:]), "lambda(") {
+		in.trace("lambda", line)
+		varName := strings.TrimSpace(line[:eq])
+		_, params, body, ok := in.parseFunctionDef(strings.TrimSpace(line[eq+1:]))
+		if !ok {
+			return flowNext
+		}
+		if in.astOnly {
+			in.dumpAST(body, true)
+			return flowNext
+		}
+		if in.checkFunctions {
+			in.checkFunctionBody(varName, params, body)
+		}
+		fn := &Function{name: varName, params: params, expression: body}
+		in.assignVariable(varName, Value{kind: KindFunction, fn: fn})
+		return flowNext
+	}
+
+	// 2) Проверим, не функция ли это:  name(arg1, arg2, ...): выражение
+	//    Признак – наличие двоеточия ':' после списка параметров
+	//    (двоеточия внутри списка задают типы параметров: f(x:i, y:f))
+	if strings.Contains(maskStrings(line), ":") {
+		in.trace("function-def", line)
+		funcName, params, right, ok := in.parseFunctionDef(line)
+		if !ok {
+			return flowNext
+		}
+
+		if in.astOnly {
+			in.dumpAST(right, true)
+			return flowNext
+		}
+		// Сохраняем функцию в карту
+		in.setFunction(funcName, params, right)
+		return flowNext
+	}
+
+	// Остальные инструкции – присваивания. Ищем знак '=', не являющийся частью
+	// операторов сравнения (==, !=, <=, >=), и делим строку на левую и правую части.
+	eq := findAssign(line)
+	var left, right string
+	if eq != -1 {
+		left = strings.TrimSpace(line[:eq])
+		right = strings.TrimSpace(line[eq+1:])
+	}
+
+	// 3) Кортежное присваивание:  (a, b, ...) = выражение
+	//    Справа – кортеж или вызов функции, возвращающей кортеж
+	if eq != -1 && strings.HasPrefix(left, "(") {
+		in.trace("tuple-assignment", line)
+		// Пример: (q, r) = divmod(7, 2)
+		if !strings.HasSuffix(left, ")") {
+			in.reportError("ОШИБКА: неверный формат кортежного присваивания: %s", line)
+			return flowNext
+		}
+		var names []string
+		for _, name := range strings.Split(left[1:len(left)-1], ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+
+		vals, ok := in.evaluateResults(right)
+		if !ok {
+			return flowNext
+		}
+		if len(vals) != len(names) {
+			in.reportError("ОШИБКА: в кортежном присваивании %d переменных, а значений %d", len(names), len(vals))
+			return flowNext
+		}
+		for i, name := range names {
+			in.assignVariable(name, vals[i])
+		}
+		return flowNext
+	}
+
+	// 4) Проверим, не инициализация ли переменной с типом:  varName(i)=..., varName(f)=...  или varName(arr)=...
+	//    Ищем шаблон:  что-то(...)=<что-то>
+	if eq != -1 && strings.HasSuffix(left, ")") {
+		in.trace("typed-init", line)
+		// Пример: myvar(i)=15
+		idxOpenParen := strings.Index(left, "(")
+		if idxOpenParen == -1 {
+			in.reportError("ОШИБКА: неверный формат при инициализации переменной: %s", line)
+			return flowNext
+		}
+		varName := strings.TrimSpace(left[:idxOpenParen])
+		typeChar := strings.TrimSpace(left[idxOpenParen+1 : len(left)-1]) // i, f или arr
+		if !in.checkVariableName(varName) {
+			return flowNext
+		}
+
+		// Вычислим выражение
+		val, ok := in.evaluateExpression(right)
+		if !ok {
+			return flowNext
+		}
+		if typeChar == "arr" {
+			// fs(arr) = [sq, cube] – переменная-массив
+			if val.kind != KindArray {
+				in.reportError("ОШИБКА: переменная %s(arr) может хранить только массив", varName)
+				return flowNext
+			}
+			in.assignVariable(varName, val)
+			return flowNext
+		}
+		if val.kind != KindNumber {
+			in.reportError("ОШИБКА: переменная %s(%s) может хранить только число", varName, typeChar)
+			return flowNext
+		}
+		if typeChar == "i" {
+			in.setVariable(varName, true, val)
+		} else if typeChar == "f" {
+			in.setVariable(varName, false, val)
+		} else {
+			in.reportError("ОШИБКА: неизвестный тип переменной: %s", typeChar)
+		}
+		return flowNext
+	}
+
+	// 5) Иначе, это либо обычное присваивание вида varName=expr,
+	//    либо что-то некорректное.
+	if eq != -1 {
+		in.trace("assignment", line)
+		var val Value
+		var ok bool
+		if strings.HasPrefix(right, "pop ") {
+			// x = pop a – значение удалённого элемента
+			val, ok = in.popArray(strings.TrimSpace(right[len("pop"):]))
+		} else {
+			val, ok = in.evaluateExpression(right)
+		}
+		if !ok {
+			return flowNext
+		}
+		in.assignVariable(left, val)
+		return flowNext
+	}
+
+	// Если ничего из вышеперечисленного не подошло, считаем строку некорректной
+	in.trace("unparseable", line)
+	in.reportError("ОШИБКА: не могу разобрать инструкцию: %s", line)
+	return flowNext
+}
+
+// processFile – построчно выполняет инструкции из файла
+func (in *Interpreter) processFile(fileName string) error {
+	absName, err := filepath.Abs(fileName)
+	if err != nil {
+		return fmt.Errorf("Ошибка открытия файла: %v", err)
+	}
+	for _, f := range in.files {
+		if f == absName {
+			return fmt.Errorf("циклическое подключение файла %s", fileName)
+		}
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("Ошибка открытия файла: %v", err)
+	}
+	defer file.Close()
+
+	in.files = append(in.files, absName)
+	defer func() { in.files = in.files[:len(in.files)-1] }()
+
+	scanner := in.newScanner(file)
+	lineNo := 1
+	for scanner.Scan() {
+		in.checkRuntime()
+		first := scanner.Text()
+		line, lines, ok := nextStatement(scanner)
+		if !ok {
+			if err := scanner.Err(); err != nil {
+				// блок оборвался на строке, которую не удалось прочитать
+				return in.readError(err, lineNo+lines)
+			}
+			in.reportError("ОШИБКА: фигурная скобка не закрыта до конца файла: %s", trimStatement(first))
+			break
+		}
+		lineNo += lines
+		in.runStatement(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return in.readError(err, lineNo)
+	}
+	return nil
+}
+
+// runFile – выполняет файл инструкций; превышение --max-runtime прерывает
+// выполнение (в том числе подключённых через include файлов) и возвращается как ошибка
+func (in *Interpreter) runFile(fileName string) (err error) {
+	defer recoverTimeout(&err)
+	return in.processFile(fileName)
+}
+
+// newScanner – построчное чтение файла инструкций с ограничением длины строки
+// --max-line-length (вместо 64 КБ по умолчанию у bufio.Scanner)
+func (in *Interpreter) newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	// +1 – для перевода строки. Scanner допускает строки длиной до большего
+	// из cap(buf) и max, поэтому начальный буфер не больше limit
+	limit := in.maxLineLength + 1
+	scanner.Buffer(make([]byte, 0, min(64*1024, limit)), limit)
+	return scanner
+}
+
+// readError – ошибка чтения файла; lineNo – номер строки, которую не удалось прочитать
+func (in *Interpreter) readError(err error, lineNo int) error {
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("строка %d слишком длинная: больше %d байт (флаг --max-line-length)", lineNo, in.maxLineLength)
+	}
+	return fmt.Errorf("Ошибка чтения файла: %v", err)
+}
+
+// nextStatement – очередная инструкция файла, начинающаяся с текущей строки scanner:
+// обычно это одна строка, но тело функции в фигурных скобках ("f(x): {" ... "}")
+// собирается из нескольких строк в одну. lines – число прочитанных строк;
+// ok = false, если скобка не закрыта до конца файла.
+func nextStatement(scanner *bufio.Scanner) (stmt string, lines int, ok bool) {
+	line := scanner.Text()
+	depth := braceDepth(line)
+	if depth <= 0 {
+		return line, 1, true
+	}
+	parts := []string{trimStatement(line)}
+	for lines = 1; depth > 0 && scanner.Scan(); lines++ {
+		depth += braceDepth(scanner.Text())
+		parts = append(parts, trimStatement(scanner.Text()))
+	}
+	return strings.Join(parts, " "), lines, depth <= 0
+}
+
+// braceDepth – разность числа открывающих и закрывающих фигурных скобок
+// в строке (без строковых литералов и комментария)
+func braceDepth(line string) int {
+	depth := 0
+	for _, r := range maskStrings(stripComment(line)) {
+		switch r {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		}
+	}
+	return depth
+}
+
+// identNames – имена (идентификаторы) в тексте инструкции; символы,
+// которые лексер не распознаёт (например, ':' или '"'), пропускаются
+func identNames(s string) []string {
+	l := NewLexer(s)
+	var names []string
+	for {
+		t := l.NextToken()
+		switch {
+		case t.typ == TokenEOF:
+			return names
+		case t.typ == TokenIdent:
+			names = append(names, t.value)
+		case t.end == t.start:
+			l.nextRune() // нераспознанный символ
+		}
+	}
+}
+
+// repl – интерактивный режим: инструкции читаются построчно из r и сразу
+// выполняются. Строки, начинающиеся с ':', – команды самого режима:
+// ":type выражение" – тип выражения без изменения состояния, ":quit" – выход.
+func (in *Interpreter) repl(r io.Reader) (err error) {
+	defer recoverTimeout(&err)
+	fmt.Fprintln(in.Out, "Интерактивный режим. :type выражение – тип выражения, :quit – выход")
+	// инструкции и команда input читают из одного буфера
+	if in.In != r {
+		in.In, in.input = r, nil
+	}
+	for {
+		fmt.Fprint(in.Out, "> ")
+		text, ok := in.readLine()
+		if !ok {
+			fmt.Fprintln(in.Out)
+			return nil
+		}
+		line := strings.TrimSpace(text)
+		if strings.HasPrefix(line, ":") {
+			if !in.replCommand(line) {
+				return nil
+			}
+			continue
+		}
+		in.runStatement(line)
+	}
+}
+
+// replCommand – выполняет команду интерактивного режима; false – выход
+func (in *Interpreter) replCommand(line string) bool {
+	cmd, arg, _ := strings.Cut(line, " ")
+	switch cmd {
+	case ":quit", ":q":
+		return false
+	case ":type":
+		expr := strings.TrimSuffix(strings.TrimSpace(arg), ";")
+		if val, ok := in.evaluateExpression(expr); ok {
+			in.printResult(typeName(val))
+		}
+	default:
+		in.reportError("ОШИБКА: неизвестная команда %s", cmd)
+	}
+	return true
+}
+
+// lintFile – проверка файла без выполнения (флаг --no-exec): функции,
+// объявленные несколько раз (действует последнее определение), и переменные,
+// которым присваивается значение, но которые нигде не читаются.
+// Подключаемые через include файлы не проверяются.
+func (in *Interpreter) lintFile(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("Ошибка открытия файла: %v", err)
+	}
+	defer file.Close()
+
+	funcLines := make(map[string]int) // функция -> строка последнего определения
+	assigned := make(map[string]int)  // переменная -> строка первого присваивания
+	var assignOrder []string
+	read := make(map[string]bool)
+	readAll := false // "print;" выводит (читает) все переменные
+	warnings := 0
+
+	scanner := in.newScanner(file)
+	lineNo := 1
+	for lines := 0; scanner.Scan(); lineNo += lines {
+		stmt, n, _ := nextStatement(scanner)
+		lines = n
+		line := colonAssign(trimStatement(stmt))
+		if line == "" {
+			continue
+		}
+		if line == "print" {
+			readAll = true
+			continue
+		}
+
+		// лямбда "sq = lambda(x): x*x" – присваивание переменной, а не определение функции
+		eq := findAssign(line)
+		lambda := eq != -1 && strings.HasPrefix(strings.TrimSpace(line[eq+1:]), "lambda(")
+
+		// определение функции: name(params): выражение
+		idx, open := strings.Index(line, ")"), strings.Index(line, "(")
+		if !lambda && open != -1 && idx > open && strings.HasPrefix(strings.TrimSpace(line[idx+1:]), ":") {
+			name := strings.TrimSpace(line[:open])
+			if prev, ok := funcLines[name]; ok {
+				in.warn("строка %d: функция %s объявлена повторно (ранее в строке %d), действует последнее определение",
+					lineNo, name, prev)
+				warnings++
+			}
+			funcLines[name] = lineNo
+			for _, n := range identNames(strings.TrimSpace(line[idx+1:])[1:]) {
+				read[n] = true
+			}
+			continue
+		}
+
+		// присваивание: левая часть – цели, правая – чтения
+		rest := line
+		if eq != -1 {
+			left := strings.TrimSpace(line[:eq])
+			rest = line[eq+1:]
+			if lambda {
+				// читаются только имена из тела лямбды
+				rest = rest[strings.Index(rest, ")")+1:]
+			}
+			var targets []string
+			switch {
+			case strings.HasPrefix(left, "("):
+				targets = strings.Split(strings.Trim(left, "()"), ",")
+			case strings.HasSuffix(left, ")") && strings.Contains(left, "("):
+				targets = []string{left[:strings.Index(left, "(")]}
+			default:
+				targets = []string{left}
+			}
+			for _, t := range targets {
+				t = strings.TrimSpace(t)
+				if _, ok := assigned[t]; !ok {
+					assigned[t] = lineNo
+					assignOrder = append(assignOrder, t)
+				}
+			}
+		}
+		for _, n := range identNames(rest) {
+			read[n] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return in.readError(err, lineNo)
+	}
+
+	if !readAll {
+		for _, name := range assignOrder {
+			if !read[name] {
+				in.warn("строка %d: переменной %s присваивается значение, но она нигде не читается",
+					assigned[name], name)
+				warnings++
+			}
+		}
+	}
+	fmt.Fprintf(in.Out, "Проверка без выполнения завершена, предупреждений: %d\n", warnings)
+	return nil
+}
+
+func main() {
+	in := NewInterpreter()
+	flag.BoolVar(&in.statsEnabled, "stats", false, "подсчитать выполненные операции и вывести итог в конце")
+	flag.BoolVar(&in.profileEnabled, "profile", false, "замерить время в каждой функции и вывести итог в конце, самые медленные – первыми")
+	flag.DurationVar(&in.maxRuntime, "max-runtime", 0, "максимальное время выполнения, например 5s (0 – без ограничения)")
+	flag.BoolVar(&in.checkFunctions, "check-functions", false, "предупреждать о неизвестных именах в теле функции при её объявлении")
+	flag.BoolVar(&in.warnRedefine, "warn-redefine", false, "предупреждать о повторном объявлении функций и переменных")
+	flag.StringVar(&in.printSep, "print-sep", " ", "разделитель значений в команде print a, b, c")
+	flag.BoolVar(&in.strictDiv, "strict-div", false, "считать деление на ноль ошибкой (по умолчанию результат – бесконечность)")
+	flag.IntVar(&in.maxIterations, "max-iterations", 1000000, "наибольшее число повторений тела цикла")
+	flag.IntVar(&in.maxVariables, "max-variables", 0, "наибольшее число переменных и, отдельно, функций (0 – без ограничения)")
+	flag.IntVar(&in.maxLineLength, "max-line-length", 1<<20, "наибольшая длина строки файла инструкций в байтах")
+	flag.IntVar(&in.maxDepth, "max-depth", 1000, "наибольшая глубина рекурсии (вложенных вызовов функций)")
+	flag.BoolVar(&in.verbose, "verbose", false, "перед выполнением выводить вид каждой инструкции (print, function-def, assignment, ...)")
+	flag.BoolVar(&in.strictTypes, "strict-types", false, "считать ошибкой арифметику над int и float без явного приведения")
+	flag.BoolVar(&in.eqCompat, "eq-compat", false, "одиночный '=' внутри скобок означает сравнение на равенство")
+	flag.BoolVar(&in.sci, "sci", false, "выводить очень большие и очень малые вещественные числа в экспоненциальной записи")
+	flag.Float64Var(&in.plainMax, "plain-max", 1e15, "вещественные с модулем от 1 до этого значения выводить без экспоненты (0 – формат %g)")
+	flag.BoolVar(&in.showSign, "sign", false, "выводить положительные числа со знаком '+' (+5, -3, 0)")
+	flag.Float64Var(&in.sciThreshold, "sci-threshold", 1e6, "порог --sci: экспоненциальная запись для модулей >= порога и < 1/порога")
+	color := flag.Bool("color", false, "выделять цветом ошибки (красным) и результаты (зелёным), если вывод идёт в терминал")
+	flag.BoolVar(&in.astOnly, "ast", false, "вывести дерево разбора каждого выражения в виде S-выражения, ничего не вычисляя")
+	interactive := flag.Bool("interactive-after-file", false, "после выполнения файла перейти в интерактивный режим с его переменными и функциями")
+	noExec := flag.Bool("no-exec", false, "только проверить файл без выполнения: повторные определения функций и непрочитанные переменные")
+	output := flag.String("output", "text", "формат вывода print: text или json")
+	locale := flag.String("locale", "c", "формат чисел во входном файле: c (десятичная точка) или ru (десятичная запятая)")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Использование: go run main.go [флаги] [<путь_к_файлу_инструкций>]")
+		fmt.Fprintln(flag.CommandLine.Output(), "Без файла запускается интерактивный режим.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch *locale {
+	case "c":
+	case "ru":
+		in.decimalComma = true
+	default:
+		fmt.Fprintln(os.Stderr, "Неизвестная локаль:", *locale)
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	switch *output {
+	case "text":
+	case "json":
+		in.jsonOutput = true
+	default:
+		fmt.Fprintln(os.Stderr, "Неизвестный формат вывода:", *output)
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	// цвета только для терминала: в файле или канале ANSI-последовательности мешают
+	in.color = *color && isTerminal(os.Stdout) && isTerminal(os.Stderr)
+
+	if in.sciThreshold <= 1 {
+		fmt.Fprintln(os.Stderr, "Порог --sci-threshold должен быть больше 1:", in.sciThreshold)
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	if in.plainMax < 0 {
+		fmt.Fprintln(os.Stderr, "Значение --plain-max не может быть отрицательным:", in.plainMax)
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	if in.maxLineLength <= 0 {
+		fmt.Fprintln(os.Stderr, "Значение --max-line-length должно быть положительным:", in.maxLineLength)
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	if flag.NArg() < 1 {
+		// без файла – интерактивный режим
+		if err := in.repl(os.Stdin); err != nil {
+			in.reportError("%v", err)
+		}
+	} else {
+		fileName := flag.Arg(0)
+		if *noExec {
+			if err := in.lintFile(fileName); err != nil {
+				in.reportError("%v", err)
+				os.Exit(1)
+			}
+			return
+		}
+		err := in.runFile(fileName)
+		if err != nil {
+			in.reportError("%v", err)
+		}
+		// файлы, не закрытые командой "writeto;", закрываются до интерактивного режима
+		in.closeRedirects()
+		if *interactive && !errors.As(err, new(timeoutError)) {
+			// состояние после файла доступно в интерактивном режиме
+			if err := in.repl(os.Stdin); err != nil {
+				in.reportError("%v", err)
+			}
+		}
+	}
+	// завершение общее для файла и интерактивного режима: незакрытые файлы
+	// writeto, итоги --stats и --profile и код завершения
+	in.closeRedirects()
+
+	if in.statsEnabled {
+		in.printStats()
+	}
+	if in.profileEnabled {
+		in.printProfile()
+	}
+
+	// Любая ошибка во время выполнения даёт ненулевой код завершения
+	if in.errorCount > 0 {
+		os.Exit(1)
+	}
 }
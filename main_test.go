@@ -0,0 +1,1770 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestInterpreter – интерпретатор, вывод и сообщения об ошибках которого
+// пишутся в буферы; ввод пуст
+func newTestInterpreter() (*Interpreter, *bytes.Buffer, *bytes.Buffer) {
+	in := NewInterpreter()
+	out, errs := new(bytes.Buffer), new(bytes.Buffer)
+	in.In, in.Out, in.Err = strings.NewReader(""), out, errs
+	return in, out, errs
+}
+
+// writeProgram – записывает текст программы во временный файл и возвращает его путь
+func writeProgram(t *testing.T, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "prog.txt")
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// runProgram – выполняет src как файл инструкций в интерпретаторе in
+func runProgram(t *testing.T, in *Interpreter, src string) {
+	t.Helper()
+	if err := in.runFile(writeProgram(t, src)); err != nil {
+		t.Fatalf("runFile: %v", err)
+	}
+}
+
+// run – выполняет src в новом интерпретаторе; setup (если задан) настраивает
+// его перед запуском, как это делают флаги. Результат – вывод и сообщения об ошибках.
+func run(t *testing.T, src string, setup ...func(in *Interpreter)) (string, string) {
+	t.Helper()
+	in, out, errs := newTestInterpreter()
+	for _, f := range setup {
+		f(in)
+	}
+	runProgram(t, in, src)
+	return out.String(), errs.String()
+}
+
+// lines – непустые строки вывода без пробелов по краям
+func lines(s string) []string {
+	var res []string
+	for _, l := range strings.Split(s, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// expectOutput – проверяет вывод программы построчно и отсутствие ошибок
+func expectOutput(t *testing.T, src string, want ...string) {
+	t.Helper()
+	out, errs := run(t, src)
+	if errs != "" {
+		t.Fatalf("неожиданные ошибки:\n%s", errs)
+	}
+	if got := lines(out); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("вывод:\n%s\nожидалось:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// expectError – проверяет, что программа сообщает об ошибке, содержащей substr
+func expectError(t *testing.T, src, substr string, setup ...func(in *Interpreter)) {
+	t.Helper()
+	_, errs := run(t, src, setup...)
+	if !strings.Contains(errs, substr) {
+		t.Fatalf("ожидалась ошибка %q, получено:\n%s", substr, errs)
+	}
+}
+
+func TestStatsCountsOperations(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	in.statsEnabled = true
+	runProgram(t, in, "x(i) = 2;\ny = x * 3 + 1;\nf(a): a * a + 1;\nz = f(y) - 2 / 1;\n")
+	got := in.stats
+	if got.additions != 2 || got.subtractions != 1 || got.multiplications != 2 ||
+		got.divisions != 1 || got.calls != 1 {
+		t.Fatalf("счётчики: %+v", got)
+	}
+}
+
+func TestStatsDisabledCountsNothing(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	runProgram(t, in, "y = 2 * 3 + 1;\n")
+	if in.stats.additions != 0 || in.stats.multiplications != 0 {
+		t.Fatalf("без --stats счётчики не должны меняться: %+v", in.stats)
+	}
+}
+
+// value – значение переменной name после выполнения программы
+func value(t *testing.T, in *Interpreter, name string) Value {
+	t.Helper()
+	v, ok := in.getVariable(name)
+	if !ok {
+		t.Fatalf("переменная %s не объявлена", name)
+	}
+	return v.get()
+}
+
+func TestTupleReturnIntoTupleAssignment(t *testing.T) {
+	in, _, errs := newTestInterpreter()
+	runProgram(t, in, "divmod(a:i, b:i): (a / b, a % b);\n(q, r) = divmod(7, 2);\n")
+	if errs.Len() != 0 {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	if q := value(t, in, "q"); q.String() != "3.5" {
+		t.Fatalf("q = %v", q)
+	}
+	if r := value(t, in, "r"); !r.IsInt() || r.Int() != 1 {
+		t.Fatalf("r = %v (%s)", r, typeName(r))
+	}
+}
+
+func TestTupleInScalarContextIsError(t *testing.T) {
+	expectError(t, "divmod(a, b): (a / b, a % b);\nx = divmod(7, 2) + 1;\n",
+		"Функция divmod возвращает 2 значений, а в выражении допустимо только одно")
+}
+
+func TestTupleWithUnknownCharacterIsError(t *testing.T) {
+	// лексер не продвигается на неизвестном символе: разбор кортежа должен остановиться
+	expectError(t, "(u, v) = (1 $ 2, 3);\n", "ОШИБКА")
+}
+
+func TestCasts(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	runProgram(t, in, "y = float(4);\nz = int(3.9);\nn = int(-3.9);\nw = float(int(7.9));\nv = int(float(int(-7.5)));\n")
+	tests := []struct {
+		name, text, typ string
+	}{
+		{"y", "4", "float"},
+		{"z", "3", "int"},
+		{"n", "-3", "int"},
+		{"w", "7", "float"},
+		{"v", "-7", "int"},
+	}
+	for _, tt := range tests {
+		v := value(t, in, tt.name)
+		if v.String() != tt.text || typeName(v) != tt.typ {
+			t.Errorf("%s = %v (%s), ожидалось %s (%s)", tt.name, v, typeName(v), tt.text, tt.typ)
+		}
+	}
+}
+
+func TestPrintUndefinedVariableIsError(t *testing.T) {
+	in, out, errs := newTestInterpreter()
+	runProgram(t, in, "print x;\ny = 1;\n")
+	if in.errorCount != 1 {
+		t.Fatalf("errorCount = %d, ожидалось 1", in.errorCount)
+	}
+	if !strings.Contains(errs.String(), `переменная "x" не объявлена`) {
+		t.Fatalf("ошибки: %q", errs)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("ошибка попала в вывод: %q", out)
+	}
+}
+
+func TestComparisonChaining(t *testing.T) {
+	expectOutput(t, "echo 1 < 2 < 3;\necho 3 < 2 < 5;\necho 1 < 2 < 2;\necho 1 < 2 <= 2 < 4;\necho 1 < 2 <= 2 < 2;\n",
+		"1", "0", "0", "1", "0")
+}
+
+func TestComparisonChainEvaluatesMiddleOnce(t *testing.T) {
+	in, out, _ := newTestInterpreter()
+	in.statsEnabled = true
+	runProgram(t, in, "f(x): x;\necho 0 < f(5) < 10;\n")
+	if strings.TrimSpace(out.String()) != "1" {
+		t.Fatalf("вывод: %q", out)
+	}
+	if n := in.stats.funcCalls["f"]; n != 1 {
+		t.Fatalf("f вызвана %d раз, ожидалось 1", n)
+	}
+}
+
+func TestDebugOriginAtGlobalScope(t *testing.T) {
+	expectOutput(t, "x = 5;\ndebug x;\ndebug y;\n",
+		"x: глобальная переменная, int = 5", "y: не объявлена")
+}
+
+func TestDebugOriginInsideFunction(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	runProgram(t, in, "x = 5;\ng = 1;\n")
+	// состояние во время вызова f(x): параметр x заменяет глобальную переменную
+	fn := &Function{name: "f", params: []Param{{name: "x"}}}
+	in.callStack = append(in.callStack, fn)
+	in.variables["x"] = newVariable(intValue(7))
+	if origin, _ := in.variableOrigin("x"); origin != "параметр функции f" {
+		t.Fatalf("x: %s", origin)
+	}
+	if origin, _ := in.variableOrigin("g"); origin != "глобальная переменная" {
+		t.Fatalf("g: %s", origin)
+	}
+}
+
+func TestZeroParameterFunction(t *testing.T) {
+	expectOutput(t, "now(): 42;\necho now();\necho now() + 1;\n", "42", "43")
+}
+
+func TestZeroParameterFunctionArity(t *testing.T) {
+	expectError(t, "now(): 42;\necho now(5);\n", "Функция now ожидала 0 аргументов, передано 1")
+}
+
+func TestEmptyParameterNameIsError(t *testing.T) {
+	in, _, errs := newTestInterpreter()
+	runProgram(t, in, "f(x,): x;\n")
+	if !strings.Contains(errs.String(), "пустое имя параметра") {
+		t.Fatalf("ошибки: %q", errs)
+	}
+	if _, ok := in.getFunction("f"); ok {
+		t.Fatal("функция с пустым именем параметра не должна объявляться")
+	}
+}
+
+func TestMaxRuntimeAbortsTightLoop(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	in.maxRuntime = 50 * time.Millisecond
+	in.maxIterations = math.MaxInt
+	start := time.Now()
+	err := in.runFile(writeProgram(t, "x = 0;\nwhile (1) do x = x + 1;\nprint x;\n"))
+	if !errors.As(err, new(timeoutError)) {
+		t.Fatalf("ожидалось прерывание по времени, получено %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("прерывание заняло %v", elapsed)
+	}
+}
+
+func TestMaxRuntimeInEvalReturnsError(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	runProgram(t, in, "f(n): f(n) + 1;\n")
+	in.maxRuntime = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, err := in.Eval("f(1)"); !errors.As(err, new(timeoutError)) {
+		t.Fatalf("Eval: %v", err)
+	}
+}
+
+func TestPrintHex(t *testing.T) {
+	expectOutput(t, "x = 255;\nprinthex x;\nz = 0;\nprinthex z;\nprintoct x;\nprintbin x;\n",
+		"x = 0xff (int)", "z = 0x0 (int)", "x = 0o377 (int)", "x = 0b11111111 (int)")
+}
+
+func TestPrintHexOfFloatIsError(t *testing.T) {
+	expectError(t, "f = 2.5;\nprinthex f;\n", `команда printhex применима только к целым переменным, "f" – float`)
+}
+
+func TestDefined(t *testing.T) {
+	expectOutput(t, "x = 1;\nf(a): a;\nprint defined(x), defined(f), defined(nope);\n", "1 1 0")
+}
+
+func TestMalformedNumberLiterals(t *testing.T) {
+	for _, src := range []string{"1.2.3", "1..2"} {
+		in, _, _ := newTestInterpreter()
+		_, err := in.Eval(src + " + 1")
+		if err == nil || !strings.Contains(err.Error(), "Неверный числовой литерал: "+src) {
+			t.Errorf("%s: %v", src, err)
+		}
+	}
+}
+
+func TestMapOverArray(t *testing.T) {
+	expectOutput(t, "sq(x): x*x;\na = [1, 2, 3];\nb = map(sq, a);\nprint b;\n", "b = [1, 4, 9] (array)")
+}
+
+func TestMapNonUnaryFunctionIsError(t *testing.T) {
+	expectError(t, "add(x, y): x + y;\na = [1, 2, 3];\nb = map(add, a);\n",
+		"Функция map ожидала функцию одного аргумента, а add принимает 2")
+}
+
+func TestTypedInitKeepsNonNumberVariable(t *testing.T) {
+	in, out, errs := newTestInterpreter()
+	in.In = strings.NewReader("5\n")
+	runProgram(t, in, "a = [1, 2, 3];\na(i) = 7;\ns = \"hi\";\ns(f) = 2.5;\ninput a;\nprint a;\nprint s;\n")
+	for _, want := range []string{
+		`переменной "a" (array) нельзя присвоить значение типа int`,
+		`переменной "s" (string) нельзя присвоить значение типа float`,
+	} {
+		if !strings.Contains(errs.String(), want) {
+			t.Errorf("нет ошибки %q:\n%s", want, errs)
+		}
+	}
+	if out.String() != "a = [1, 2, 3] (array)\ns = hi (string)\n" {
+		t.Fatalf("вывод: %q", out)
+	}
+}
+
+func TestPrintOutputIsCaptured(t *testing.T) {
+	in := NewInterpreter()
+	var out, errs bytes.Buffer
+	in.Out, in.Err = &out, &errs
+	in.runStatement("x = 2 + 3;")
+	in.runStatement("print x;")
+	in.runStatement("print y;")
+	if out.String() != "x = 5 (int)\n" {
+		t.Fatalf("Out: %q", out.String())
+	}
+	if !strings.Contains(errs.String(), `переменная "y" не объявлена`) {
+		t.Fatalf("Err: %q", errs.String())
+	}
+}
+
+func TestPowerTypeInference(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	runProgram(t, in, "x(i) = 2;\ny = x^3;\nr = 2^0.5;\nh = x^-1;\nf = 2.0^2;\n")
+	tests := []struct {
+		name, text, typ string
+	}{
+		{"y", "8", "int"},
+		{"r", "1.4142135623730951", "float"},
+		{"h", "0.5", "float"},
+		{"f", "4", "float"},
+	}
+	for _, tt := range tests {
+		v := value(t, in, tt.name)
+		if v.String() != tt.text || typeName(v) != tt.typ {
+			t.Errorf("%s = %v (%s), ожидалось %s (%s)", tt.name, v, typeName(v), tt.text, tt.typ)
+		}
+	}
+}
+
+func TestWarnRedefine(t *testing.T) {
+	warnOn := func(in *Interpreter) { in.warnRedefine = true }
+	_, errs := run(t, "f(x): x;\nx(i) = 1;\n", warnOn)
+	if errs != "" {
+		t.Fatalf("первое объявление не должно давать предупреждений: %q", errs)
+	}
+	_, errs = run(t, "f(x): x;\nf(x): x + 1;\nx(i) = 1;\nx(i) = 2;\n", warnOn)
+	for _, want := range []string{"функция f переопределена", "переменная x объявлена повторно"} {
+		if !strings.Contains(errs, want) {
+			t.Errorf("нет предупреждения %q:\n%s", want, errs)
+		}
+	}
+	if _, errs := run(t, "f(x): x;\nf(x): x + 1;\n"); errs != "" {
+		t.Fatalf("без флага предупреждений нет: %q", errs)
+	}
+}
+
+// evalText – значение выражения в новом интерпретаторе в виде текста вывода
+func evalText(t *testing.T, expr string) string {
+	t.Helper()
+	in, _, _ := newTestInterpreter()
+	v, err := in.Eval(expr)
+	if err != nil {
+		t.Fatalf("%s: %v", expr, err)
+	}
+	return in.printValue(v)
+}
+
+func TestSumRangeAndProdRange(t *testing.T) {
+	tests := []struct{ expr, want string }{
+		{"sumrange(1, 100)", "5050"},
+		{"sumrange(5, 1)", "15"},
+		{"sumrange(7, 7)", "7"},
+		{"sumrange(-9223372036854775808, 9223372036854775807)", "-9223372036854775808"},
+		{"prodrange(1, 5)", "120"},
+		{"prodrange(5, 1)", "120"},
+		{"prodrange(4, 4)", "4"},
+		{"prodrange(-3, -1)", "-6"},
+		{"prodrange(-5, 5)", "0"},
+		{"prodrange(1, 100000000000)", "+Inf"},
+		{"prodrange(-100000000001, -1)", "-Inf"},
+		{"prodrange(9223372036854775806, 9223372036854775807)", "8.507059173023462e+37"},
+	}
+	for _, tt := range tests {
+		if got := evalText(t, tt.expr); got != tt.want {
+			t.Errorf("%s = %s, ожидалось %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestSumRangeNonIntegerBoundIsError(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	if _, err := in.Eval("sumrange(1.5, 3)"); err == nil || !strings.Contains(err.Error(), "целыми") {
+		t.Fatalf("ожидалась ошибка о целых границах, получено %v", err)
+	}
+}
+
+func TestErrorCaretUnderToken(t *testing.T) {
+	_, errs := run(t, "x = 2 + * 3;\nf(a): a;\ny = 1 + f(1, 2);\n")
+	want := "ОШИБКА при вычислении выражения: Неожиданный токен: *\n" +
+		"    2 + * 3\n" +
+		"        ^\n"
+	if !strings.HasPrefix(errs, want) {
+		t.Fatalf("получено:\n%s\nожидалось:\n%s", errs, want)
+	}
+	if !strings.Contains(errs, "    1 + f(1, 2)\n        ^^^^^^^\n") {
+		t.Fatalf("вызов подчёркивается целиком:\n%s", errs)
+	}
+}
+
+func TestPrintSeveralExpressions(t *testing.T) {
+	expectOutput(t, "a = 2;\nb = 0.5;\nprint a, a+1, b;\n", "2 3 0.5")
+}
+
+func TestPrintSeparator(t *testing.T) {
+	out, _ := run(t, "a = 2;\nprint a, a*10;\n", func(in *Interpreter) { in.printSep = ", " })
+	if out != "2, 20\n" {
+		t.Fatalf("вывод: %q", out)
+	}
+}
+
+func TestIntegerAboveInt64Max(t *testing.T) {
+	in, _, errs := newTestInterpreter()
+	runProgram(t, in, "x(i) = 9223372036854775808;\ny(f) = 9223372036854775808;\nw(i) = 9223372036854775807;\n")
+	if !strings.Contains(errs.String(), "число слишком большое для целой переменной x") {
+		t.Fatalf("ошибки: %q", errs)
+	}
+	if _, ok := in.getVariable("x"); ok {
+		t.Fatal("переменная x не должна создаваться")
+	}
+	if y := value(t, in, "y"); y.IsInt() || y.Float() != 9223372036854775808 {
+		t.Fatalf("y = %v (%s)", y, typeName(y))
+	}
+	if w := value(t, in, "w"); !w.IsInt() || w.Int() != math.MaxInt64 {
+		t.Fatalf("w = %v (%s)", w, typeName(w))
+	}
+}
+
+func TestReverseAndSort(t *testing.T) {
+	expectOutput(t, "a = [3, 1.5, 2];\nreverse(a);\nprint a;\nsort(a);\nprint a;\nsort(a, desc);\nprint a;\n",
+		"a = [2, 1.5, 3] (array)", "a = [1.5, 2, 3] (array)", "a = [3, 2, 1.5] (array)")
+}
+
+func TestSortNonArrayIsError(t *testing.T) {
+	expectError(t, "x = 1;\nsort(x);\n", `переменная "x" не является массивом`)
+	expectError(t, "x = 1;\nreverse(x);\n", `переменная "x" не является массивом`)
+}
+
+func TestBuiltinArity(t *testing.T) {
+	tests := []struct{ expr, want string }{
+		{"gcd(4)", "Функция gcd ожидала 2 аргументов, передано 1"},
+		{"gcd(4, 6, 8)", "Функция gcd ожидала 2 аргументов, передано 3"},
+		{"min()", "Функция min ожидала не менее 1 аргументов, передано 0"},
+		{"format()", "Функция format ожидала не менее 1 аргументов, передано 0"},
+		{"count_vars(1)", "Функция count_vars ожидала 0 аргументов, передано 1"},
+	}
+	for _, tt := range tests {
+		in, _, _ := newTestInterpreter()
+		if _, err := in.Eval(tt.expr); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v", tt.expr, err)
+		}
+	}
+	if got := evalText(t, "max(1, 7, 3, 5)"); got != "7" {
+		t.Errorf("max = %s", got)
+	}
+}
+
+func TestBuiltinMaxArity(t *testing.T) {
+	b := &Builtin{minArgs: 1, maxArgs: 3}
+	if msg := b.checkArity("f", 4); msg != "Функция f ожидала не более 3 аргументов, передано 4" {
+		t.Fatalf("%q", msg)
+	}
+	if msg := b.checkArity("f", 2); msg != "" {
+		t.Fatalf("%q", msg)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	out, errs := run(t, "x = 5;\ny = 2.5;\nprint x;\nprint x, x + 1;\nprint;\n",
+		func(in *Interpreter) { in.jsonOutput = true })
+	if errs != "" {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	want := []string{
+		`{"name":"x","type":"int","value":5}`,
+		`[{"expr":"x","type":"int","value":5},{"expr":"x + 1","type":"int","value":6}]`,
+		`[{"name":"x","type":"int","value":5},{"name":"y","type":"float","value":2.5}]`,
+	}
+	if got := lines(out); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("вывод:\n%s", out)
+	}
+}
+
+func TestTypedParameters(t *testing.T) {
+	expectOutput(t, "f(x:i, y:f): x + y;\necho f(3.9, 2);\necho f(3, 0.5);\ng(x:i): x * 2;\nprint g(2.7);\n",
+		"5", "3.5", "4")
+}
+
+func TestUnknownParameterTypeIsError(t *testing.T) {
+	expectError(t, "h(x:q): x;\n", "неизвестный тип параметра x: q")
+}
+
+// errorCount – число ошибок после выполнения программы
+func errorCount(t *testing.T, src string) int {
+	t.Helper()
+	in, _, _ := newTestInterpreter()
+	runProgram(t, in, src)
+	return in.errorCount
+}
+
+func TestAssertClose(t *testing.T) {
+	tests := []struct {
+		src    string
+		errors int
+	}{
+		{"x = 0.1 + 0.2;\nassert_close(x, 0.3, 0.0001);\n", 0},
+		{"x = 0.1 + 0.2;\nassert_close(x, 0.4, 0.0001);\n", 1},
+		{"assert_close(2, 2, 0);\n", 0},
+		{"x = 0.1 + 0.2;\nassert_close(x, 0.3, 0);\n", 1},
+		{"assert_close(1, 2);\n", 1},
+	}
+	for _, tt := range tests {
+		if n := errorCount(t, tt.src); n != tt.errors {
+			t.Errorf("%q: ошибок %d, ожидалось %d", tt.src, n, tt.errors)
+		}
+	}
+}
+
+func TestNegativeIndex(t *testing.T) {
+	expectOutput(t, "a = [1, 2, 3];\nprint a[-1], a[-2], a[-len(a)];\n", "3 2 1")
+	expectError(t, "a = [1, 2, 3];\nx = a[-4];\n", "Индекс -4 вне границ массива a (длина 3)")
+}
+
+func TestPushAndPop(t *testing.T) {
+	expectOutput(t, "a = [1];\npush a, 2 + 3;\nprint a;\nx = pop a;\nprint x, len(a);\npop a;\nprint a;\n",
+		"a = [1, 5] (array)", "5 1", "a = [] (array)")
+}
+
+func TestPopEmptyAndPushNonArray(t *testing.T) {
+	expectError(t, "a = [1];\npop a;\npop a;\n", `pop из пустого массива "a"`)
+	expectError(t, "n = 1;\npush n, 2;\n", `переменная "n" не является массивом`)
+}
+
+func TestShadowedGlobalRestoredAfterError(t *testing.T) {
+	in, _, errs := newTestInterpreter()
+	runProgram(t, in, "x(i) = 10;\nf(x): x + nope;\ny = f(1);\ng(x): g(x);\nz = g(2);\n")
+	if !strings.Contains(errs.String(), `не объявленной переменной "nope"`) {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	if x := value(t, in, "x"); !x.IsInt() || x.Int() != 10 {
+		t.Fatalf("x = %v (%s), ожидалось 10 (int)", x, typeName(x))
+	}
+	if len(in.callStack) != 0 {
+		t.Fatalf("стек вызовов не пуст: %d", len(in.callStack))
+	}
+}
+
+func TestDecimalCommaLocale(t *testing.T) {
+	ru := func(in *Interpreter) { in.decimalComma = true }
+	out, errs := run(t, "x = 3,14;\nprint x;\nprint max(3, 14), 2,5 * 2;\n", ru)
+	if errs != "" {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	if got := strings.Join(lines(out), "\n"); got != "x = 3.14 (float)\n14 5" {
+		t.Fatalf("вывод:\n%s", got)
+	}
+	if got := decimalCommas(`f(1,5, 2) + "a,1"`); got != `f(1.5, 2) + "a,1"` {
+		t.Fatalf("decimalCommas: %s", got)
+	}
+	// запятые внутри строковых литералов не трогаем, в том числе после кириллицы
+	if got := decimalCommas(`s = "1,5" + "ё2,5"; ж1,5 + 2,5`); got != `s = "1,5" + "ё2,5"; ж1,5 + 2.5` {
+		t.Fatalf("decimalCommas: %s", got)
+	}
+	if out, _ := run(t, "s = \"1,5\";\nprint s;\n", ru); out != "s = 1,5 (string)\n" {
+		t.Fatalf("вывод: %q", out)
+	}
+}
+
+func TestFlooredDivision(t *testing.T) {
+	expectOutput(t, "print 7 // 2, -7 // 2, 7 // -2, 7.5 // 2;\nx = 1 // 0;\nprint x;\n",
+		"3 -4 -4 3", "x = +Inf (float)")
+	expectError(t, "x = 1 // 0;\n", "Деление на ноль", func(in *Interpreter) { in.strictDiv = true })
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	lib := "sq(x): x*x;\nk = 3;\n"
+	if err := os.WriteFile(filepath.Join(dir, "lib.txt"), []byte(lib), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	prog := filepath.Join(dir, "main.txt")
+	if err := os.WriteFile(prog, []byte("include \"lib.txt\";\necho sq(k);\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	in, out, errs := newTestInterpreter()
+	if err := in.runFile(prog); err != nil || errs.Len() != 0 {
+		t.Fatalf("runFile: %v %s", err, errs)
+	}
+	if out.String() != "9\n" {
+		t.Fatalf("вывод: %q", out)
+	}
+}
+
+func TestIncludeCycleAndMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	self := filepath.Join(dir, "self.txt")
+	if err := os.WriteFile(self, []byte("include \"self.txt\";\necho 1;\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	in, out, errs := newTestInterpreter()
+	if err := in.runFile(self); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(errs.String(), "циклическое подключение файла") || out.String() != "1\n" {
+		t.Fatalf("вывод %q, ошибки %q", out, errs)
+	}
+	expectError(t, "include \"missing.txt\";\n", "missing.txt")
+}
+
+func TestRepeat(t *testing.T) {
+	expectOutput(t, "x = 0;\nrepeat 5 do x = x + 1;\nprint x;\nrepeat 0 do x = 100;\nprint x;\nrepeat 2.9 do x = x + 1;\nprint x;\n",
+		"x = 5 (int)", "x = 5 (int)", "x = 7 (int)")
+	expectError(t, "repeat -1 do x = 0;\n", "отрицательное число повторений: -1")
+	expectError(t, "repeat 11 do x = 0;\n", "число повторений 11 превышает ограничение 10",
+		func(in *Interpreter) { in.maxIterations = 10 })
+}
+
+func TestRepeatWithDefaultLimit(t *testing.T) {
+	// интерпретатор, созданный через NewInterpreter без флагов, выполняет циклы
+	in := NewInterpreter()
+	var out bytes.Buffer
+	in.Out = &out
+	in.runStatement("x = 0;")
+	in.runStatement("repeat 3 do x = x + 1;")
+	in.runStatement("echo x;")
+	if out.String() != "3\n" || in.errorCount != 0 {
+		t.Fatalf("вывод %q, ошибок %d", out.String(), in.errorCount)
+	}
+}
+
+func TestPerFunctionCallCounts(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	in.statsEnabled = true
+	in.maxDepth = 5
+	runProgram(t, in, "f(n): f(n - 1) + 1;\nx = f(3);\nsq(x): x*x;\ng(x): sq(x) + sq(x + 1);\ny = g(1) + g(2);\n")
+	// рекурсия без выхода прерывается на глубине 5: f вызвана 5 раз
+	want := map[string]int{"f": 5, "g": 2, "sq": 4}
+	for name, n := range want {
+		if got := in.stats.funcCalls[name]; got != n {
+			t.Errorf("%s: %d вызовов, ожидалось %d", name, got, n)
+		}
+	}
+}
+
+func TestUnderscoresInNumbers(t *testing.T) {
+	for expr, want := range map[string]string{"1_000_000": "1000000", "1_000.000_1": "1000.0001"} {
+		if got := evalText(t, expr); got != want {
+			t.Errorf("%s = %s, ожидалось %s", expr, got, want)
+		}
+	}
+	for _, lit := range []string{"1_", "1_.0", "1._0", "1__0"} {
+		in, _, _ := newTestInterpreter()
+		if _, err := in.Eval(lit); err == nil || !strings.Contains(err.Error(), "Неверный числовой литерал: "+lit) {
+			t.Errorf("%s: %v", lit, err)
+		}
+	}
+	// _1 – идентификатор, а не число
+	in, _, _ := newTestInterpreter()
+	if _, err := in.Eval("_1"); err == nil {
+		t.Error("_1: ожидалась ошибка")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	runProgram(t, in, "x(i) = 5;\ny = 2.5;\na = [1, 2];\nf(v): v + 1;\n")
+	snap := in.Snapshot()
+	runProgram(t, in, "x = 7;\ny = 1;\npush a, 3;\nz = 1;\nf(v): v * 10;\ng(v): v;\n")
+	in.Restore(snap)
+	checks := []struct{ name, text, typ string }{
+		{"x", "5", "int"},
+		{"y", "2.5", "float"},
+		{"a", "[1, 2]", "array"},
+	}
+	for _, c := range checks {
+		v := value(t, in, c.name)
+		if v.String() != c.text || typeName(v) != c.typ {
+			t.Errorf("%s = %v (%s), ожидалось %s (%s)", c.name, v, typeName(v), c.text, c.typ)
+		}
+	}
+	if _, ok := in.getVariable("z"); ok {
+		t.Error("z не должна существовать после Restore")
+	}
+	if _, ok := in.functions["g"]; ok {
+		t.Error("g не должна существовать после Restore")
+	}
+	if got, _ := in.Eval("f(1)"); got.String() != "2" {
+		t.Errorf("f(1) = %v", got)
+	}
+	// снимок не меняется и восстанавливается повторно
+	runProgram(t, in, "x = 9;\n")
+	in.Restore(snap)
+	if x := value(t, in, "x"); x.Int() != 5 {
+		t.Errorf("повторное Restore: x = %v", x)
+	}
+	in.Reset()
+	if len(in.variables) != 0 || len(in.functions) != 0 {
+		t.Error("Reset не очистил состояние")
+	}
+}
+
+func TestGcdLcm(t *testing.T) {
+	expectOutput(t, "print gcd(7, 9), lcm(7, 9), gcd(12, 18), lcm(4, 6), gcd(0, 0), gcd(0, 5), lcm(0, 5), gcd(-12, 18);\n",
+		"1 63 6 12 0 5 0 6")
+	expectError(t, "x = gcd(1.5, 3);\n", "Функция gcd: аргументы должны быть целыми числами")
+}
+
+func TestTokenOffsets(t *testing.T) {
+	// смещения в рунах: кириллическое имя занимает по одной позиции на букву
+	l := NewLexer("foo + 12.5*(бар)")
+	want := []struct {
+		text       string
+		start, end int
+	}{
+		{"foo", 0, 3}, {"+", 4, 5}, {"12.5", 6, 10}, {"*", 10, 11},
+		{"(", 11, 12}, {"бар", 12, 15}, {")", 15, 16},
+	}
+	for _, w := range want {
+		tok := l.NextToken()
+		if tok.start != w.start || tok.end != w.end || string(l.input[tok.start:tok.end]) != w.text {
+			t.Errorf("%q: [%d, %d), ожидалось [%d, %d)", w.text, tok.start, tok.end, w.start, w.end)
+		}
+	}
+	if tok := l.NextToken(); tok.typ != TokenEOF {
+		t.Errorf("ожидался конец ввода, получено %q", tok.value)
+	}
+}
+
+func TestLintRedefinedFunctionAndUnreadVariable(t *testing.T) {
+	in, out, errs := newTestInterpreter()
+	if err := in.lintFile(writeProgram(t, "f(x): x;\nu = 1;\nr = 2;\nf(x): x + 1;\nprint r;\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := "ПРЕДУПРЕЖДЕНИЕ: строка 4: функция f объявлена повторно (ранее в строке 1), действует последнее определение\n" +
+		"ПРЕДУПРЕЖДЕНИЕ: строка 2: переменной u присваивается значение, но она нигде не читается\n"
+	if errs.String() != want {
+		t.Fatalf("предупреждения:\n%s", errs)
+	}
+	if out.String() != "Проверка без выполнения завершена, предупреждений: 2\n" {
+		t.Fatalf("вывод: %q", out)
+	}
+	// файл не выполняется
+	if len(in.variables) != 0 || len(in.functions) != 0 {
+		t.Fatal("--no-exec не должен выполнять инструкции")
+	}
+}
+
+func TestLintLambdaIsAssignment(t *testing.T) {
+	in, out, errs := newTestInterpreter()
+	src := "k = 3;\nsq = lambda(x): x * k;\nsq = lambda(x): x * x;\nid = lambda(x): x;\necho sq(2);\n"
+	if err := in.lintFile(writeProgram(t, src)); err != nil {
+		t.Fatal(err)
+	}
+	// повторное присваивание лямбды – не переопределение функции; k читается в теле
+	want := "ПРЕДУПРЕЖДЕНИЕ: строка 4: переменной id присваивается значение, но она нигде не читается\n"
+	if errs.String() != want {
+		t.Fatalf("предупреждения:\n%s", errs)
+	}
+	if out.String() != "Проверка без выполнения завершена, предупреждений: 1\n" {
+		t.Fatalf("вывод: %q", out)
+	}
+}
+
+func TestEqCompatMode(t *testing.T) {
+	eq := func(in *Interpreter) { in.eqCompat = true }
+	out, errs := run(t, "a = 1;\nb = 1;\nx = (a = b);\na = 2;\nprint x, a, (a = b);\n", eq)
+	if errs != "" {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	// верхний уровень – присваивание, внутри скобок – сравнение
+	if strings.TrimSpace(out) != "1 2 0" {
+		t.Fatalf("вывод: %q", out)
+	}
+	expectError(t, "a = 1;\nx = (a = 1);\n", "Ожидалась закрывающая скобка )")
+}
+
+func TestLerpClamp01(t *testing.T) {
+	expectOutput(t, "print lerp(2, 10, 0), lerp(2, 10, 1), lerp(2, 10, 0.5);\nprint clamp01(-0.5), clamp01(0.25), clamp01(3);\n",
+		"2 10 6", "0 0.25 1")
+	in, _, _ := newTestInterpreter()
+	if v, _ := in.Eval("lerp(2, 10, 0)"); v.IsInt() {
+		t.Error("результат lerp должен быть вещественным")
+	}
+}
+
+func TestVerboseClassification(t *testing.T) {
+	_, errs := run(t, "print 1;\nf(x): x;\nx(i) = 2;\ny = 3;\nthis is bad\n",
+		func(in *Interpreter) { in.verbose = true })
+	want := []string{
+		"[print] print 1",
+		"[function-def] f(x): x",
+		"[typed-init] x(i) = 2",
+		"[assignment] y = 3",
+		"[unparseable] this is bad",
+		"ОШИБКА: не могу разобрать инструкцию: this is bad",
+	}
+	if got := lines(errs); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("журнал:\n%s", errs)
+	}
+}
+
+func TestIntegerLiteralsNear2Pow53(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	runProgram(t, in, "x = 9007199254740993;\ny(f) = 9007199254740993;\nz = 9007199254740993 - 9007199254740992;\n")
+	// целый путь разбора точен, вещественный округляет до 2^53
+	if x := value(t, in, "x"); !x.IsInt() || x.Int() != 9007199254740993 {
+		t.Errorf("x = %v (%s)", x, typeName(x))
+	}
+	if y := value(t, in, "y"); y.IsInt() || y.Float() != 9007199254740992 {
+		t.Errorf("y = %v (%s)", y, typeName(y))
+	}
+	if z := value(t, in, "z"); !z.IsInt() || z.Int() != 1 {
+		t.Errorf("z = %v (%s)", z, typeName(z))
+	}
+}
+
+func TestArgminArgmax(t *testing.T) {
+	expectOutput(t, "print argmin([3, 1, 2]), argmax([3, 1, 5]), argmin([2, 1, 1]), argmax([5, 5, 1]);\n", "1 2 1 0")
+	expectError(t, "a = [];\nx = argmin(a);\n", "Функция argmin: массив пуст")
+	expectError(t, "a = [];\nx = argmax(a);\n", "Функция argmax: массив пуст")
+}
+
+func TestEvalReturnsTypedValue(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	v, err := in.Eval("2 + 3")
+	if err != nil || !v.IsInt() || v.Int() != 5 || v.Kind() != KindNumber {
+		t.Fatalf("2 + 3: %v (int=%t), %v", v, v.IsInt(), err)
+	}
+	v, err = in.Eval("7 / 2")
+	if err != nil || v.IsInt() || v.Float() != 3.5 {
+		t.Fatalf("7 / 2: %v (int=%t), %v", v, v.IsInt(), err)
+	}
+	v, err = in.Eval("[1, 2]")
+	if err != nil || v.Kind() != KindArray || len(v.Elems()) != 2 {
+		t.Fatalf("[1, 2]: %v, %v", v, err)
+	}
+	if _, err := in.Eval("1 +"); err == nil {
+		t.Fatal("ожидалась ошибка разбора")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	expectOutput(t, "a = 3;\nb = 4;\ns = format(\"%d-%d\", a, b);\nprint s;\necho format(\"%5.2f|%s|%%\", 3.14159, \"ok\");\n",
+		"s = 3-4 (string)", "3.14|ok|%")
+}
+
+func TestFormatMismatch(t *testing.T) {
+	expectError(t, "x = format(\"%d\", 2.5);\n", "Функция format: формат %d ожидает целое, получено float")
+	expectError(t, "x = format(\"%d %d\", 1);\n", "Функция format: для формата %d не хватает аргумента")
+	expectError(t, "x = format(\"%d\", 1, 2);\n", "лишние аргументы")
+}
+
+func TestWriteto(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.txt")
+	out, errs := run(t, "x = 1;\nwriteto \""+path+"\";\nprint x;\necho x + 1;\nwriteto;\necho 3;\n")
+	if errs != "" {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "x = 1 (int)\n2\n" {
+		t.Fatalf("файл: %q", data)
+	}
+	if out != "3\n" {
+		t.Fatalf("вывод после writeto;: %q", out)
+	}
+}
+
+func TestWritetoOpenErrorKeepsOutput(t *testing.T) {
+	out, errs := run(t, "writeto \"/nonexistent/dir/o.txt\";\necho 1;\n")
+	if !strings.Contains(errs, "ОШИБКА: writeto:") || out != "1\n" {
+		t.Fatalf("вывод %q, ошибки %q", out, errs)
+	}
+}
+
+func TestEmptyAndCommentOnlyFiles(t *testing.T) {
+	for _, src := range []string{"", "\n\n   \n", "# только комментарии\n\n  # ещё один\n;\n"} {
+		in, out, errs := newTestInterpreter()
+		runProgram(t, in, src)
+		if out.Len() != 0 || errs.Len() != 0 || in.errorCount != 0 {
+			t.Errorf("%q: вывод %q, ошибки %q, errorCount %d", src, out, errs, in.errorCount)
+		}
+	}
+}
+
+func TestDoWhile(t *testing.T) {
+	expectOutput(t, "x = 0;\ndo x = x + 1 while (x < 0);\nprint x;\ny = 0;\ndo y = y + 2 while (y < 7);\nprint y;\nwhile (y < 10) do y = y + 1;\nprint y;\n",
+		"x = 1 (int)", "y = 8 (int)", "y = 10 (int)")
+	expectError(t, "x = 0;\ndo x = x + 1 while (1);\n", "цикл превысил ограничение 5 итераций",
+		func(in *Interpreter) { in.maxIterations = 5 })
+}
+
+func TestInvalidVariableNames(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{"1x = 5;\n", `недопустимое имя переменной "1x"`},
+		{"x-y = 1;\n", `недопустимое имя переменной "x-y"`},
+		{"repeat(i) = 2;\n", `"repeat" – зарезервированное слово и не может быть именем переменной`},
+		{"min = 2;\n", `"min" – встроенная функция и не может быть именем переменной`},
+	}
+	for _, tt := range tests {
+		in, _, errs := newTestInterpreter()
+		runProgram(t, in, tt.src)
+		if !strings.Contains(errs.String(), tt.want) {
+			t.Errorf("%q: %s", tt.src, errs)
+		}
+		if len(in.variables) != 0 {
+			t.Errorf("%q: переменная создана", tt.src)
+		}
+	}
+}
+
+func TestInvalidFunctionNames(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{"(x): x + 1;\n", `недопустимое имя функции ""`},
+		{"1bad(x): x;\n", `недопустимое имя функции "1bad"`},
+		{"print(x): x;\n", `"print" – зарезервированное слово и не может быть именем функции`},
+		{"min(x): x * 100;\n", `"min" – встроенная функция и не может быть переопределена`},
+		{"f(x): x;\nrename f max;\n", `"max" – встроенная функция и не может быть переопределена`},
+	}
+	for _, tt := range tests {
+		in, _, errs := newTestInterpreter()
+		runProgram(t, in, tt.src)
+		if !strings.Contains(errs.String(), tt.want) {
+			t.Errorf("%q: %s", tt.src, errs)
+		}
+		for name := range in.functions {
+			if name != "f" {
+				t.Errorf("%q: создана функция %q", tt.src, name)
+			}
+		}
+	}
+}
+
+func TestInvalidParameterNames(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{"h(x, x): x;\n", "параметр x повторяется в определении функции"},
+		{"k(y, y:i): y;\n", "параметр y повторяется в определении функции"},
+		{"f(a b): 1;\n", `недопустимое имя переменной "a b"`},
+		{"g(min): min + 1;\n", `"min" – встроенная функция и не может быть именем переменной`},
+	}
+	for _, tt := range tests {
+		in, _, errs := newTestInterpreter()
+		runProgram(t, in, "x = 100;\n"+tt.src)
+		if !strings.Contains(errs.String(), tt.want) {
+			t.Errorf("%q: %s", tt.src, errs)
+		}
+		if len(in.functions) != 0 {
+			t.Errorf("%q: функция создана", tt.src)
+		}
+	}
+	// вызов не объявленной функции не меняет глобальную переменную x
+	out, _ := run(t, "x = 100;\nh(x, x): x;\ny = h(1, 2);\nprint x;\n")
+	if out != "x = 100 (int)\n" {
+		t.Fatalf("вывод: %q", out)
+	}
+}
+
+func TestReplTypeCommand(t *testing.T) {
+	in, out, _ := newTestInterpreter()
+	if err := in.repl(strings.NewReader(":type 2+2\n:type 2/3\n:type [1]\n:quit\n")); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(out.String(), "\n")
+	want := []string{
+		"Интерактивный режим. :type выражение – тип выражения, :quit – выход",
+		"> int", "> float", "> array", "> ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("вывод:\n%s", out)
+	}
+	if len(in.variables) != 0 {
+		t.Fatal(":type не должен менять состояние")
+	}
+}
+
+func TestEmptyArgumentSlots(t *testing.T) {
+	tests := []struct{ expr, want string }{
+		{"f(1,)", "Пропущен аргумент 2 в вызове функции\n    f(1,)\n        ^"},
+		{"f(,1)", "Пропущен аргумент 1 в вызове функции\n    f(,1)\n      ^"},
+		{"f(1,,2)", "Пропущен аргумент 2 в вызове функции\n    f(1,,2)\n        ^"},
+	}
+	for _, tt := range tests {
+		in, _, _ := newTestInterpreter()
+		runProgram(t, in, "f(a, b): a;\n")
+		if _, err := in.Eval(tt.expr); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v", tt.expr, err)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	expectOutput(t, "x = 1;\nrename x y;\nprint y;\nf(a): a + 1;\nrename f g;\necho g(1);\n",
+		"y = 1 (int)", "2")
+	// переменная переименовывается раньше одноимённой функции
+	expectOutput(t, "h(a): a;\nh = 5;\nrename h k;\nprint k;\necho h(3);\n", "k = 5 (int)", "3")
+}
+
+func TestRenameErrors(t *testing.T) {
+	expectError(t, "y = 1;\nz = 2;\nrename y z;\n", `переменная "z" уже существует`)
+	expectError(t, "f(a): a;\ng(a): a;\nrename f g;\n", `функция "g" уже существует`)
+	expectError(t, "rename nope q;\n", `нет переменной или функции "nope"`)
+	// новое имя проверяется и среди функций, и среди переменных
+	expectError(t, "x = 1;\ng(a): a;\nrename x g;\n", `функция "g" уже существует`)
+	expectError(t, "x = 1;\ng(a): a;\nrename g x;\n", `переменная "x" уже существует`)
+	expectError(t, "x = 1;\nrename x print;\n", `"print" – зарезервированное слово`)
+	expectError(t, "g(a): a;\nrename g while;\n", `"while" – зарезервированное слово`)
+	expectError(t, "x = 1;\nrename x gcd;\n", `"gcd" – встроенная функция`)
+}
+
+func TestScientificAndInfTypedInit(t *testing.T) {
+	in, out, _ := newTestInterpreter()
+	runProgram(t, in, "x(f) = 1e-9;\nprint x;\ny(f) = 1/0;\nprint y;\nz(f) = 2.5E+3;\n")
+	if x := value(t, in, "x"); x.Float() != 1e-9 {
+		t.Errorf("x = %v", x.Float())
+	}
+	if y := value(t, in, "y"); !math.IsInf(y.Float(), 1) {
+		t.Errorf("y = %v", y.Float())
+	}
+	if z := value(t, in, "z"); z.Float() != 2500 || z.IsInt() {
+		t.Errorf("z = %v (%s)", z, typeName(z))
+	}
+	if out.String() != "x = 1e-09 (float)\ny = +Inf (float)\n" {
+		t.Errorf("вывод: %q", out)
+	}
+}
+
+func TestLambda(t *testing.T) {
+	expectOutput(t, "sq = lambda(x): x*x;\necho sq(3);\na = [1, 2, 3];\nprint map(sq, a);\nprint sq;\n",
+		"9", "[1, 4, 9]", "sq = lambda(x): x*x (function)")
+	expectError(t, "sq = lambda(x): x*x;\ny = sq + 1;\n", "Операция не применима к функции")
+}
+
+func TestPrintLeadingEqualsIsError(t *testing.T) {
+	out, errs := run(t, "x = 1;\nprint =x;\nprint x;\n")
+	if !strings.Contains(errs, "Неожиданный токен: =") {
+		t.Fatalf("ошибки: %q", errs)
+	}
+	if out != "x = 1 (int)\n" {
+		t.Fatalf("вывод: %q", out)
+	}
+}
+
+func TestASTDump(t *testing.T) {
+	in, out, errs := newTestInterpreter()
+	in.astOnly = true
+	runProgram(t, in, "x = 2 + 3 * 4;\nprint (1 + 2) * 3;\n")
+	if errs.Len() != 0 {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	if got := strings.Join(lines(out.String()), "\n"); got != "(+ 2 (* 3 4))\n(* (+ 1 2) 3)" {
+		t.Fatalf("вывод:\n%s", got)
+	}
+	if _, ok := in.getVariable("x"); ok {
+		t.Fatal("--ast не должен вычислять присваивания")
+	}
+}
+
+func TestInlineFunctionResultType(t *testing.T) {
+	expectOutput(t, "f(x:i): x * 2;\ng(x): x / 4;\nprint f(2);\nprint g(2);\n", "4", "0.5")
+
+	in, _, _ := newTestInterpreter()
+	runProgram(t, in, "f(x:i): x * 2;\ng(x): x / 4;\n")
+	for expr, isInt := range map[string]bool{"f(2)": true, "g(2)": false} {
+		v, err := in.Eval(expr)
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if v.IsInt() != isInt {
+			t.Errorf("%s = %v (%s)", expr, v, typeName(v))
+		}
+	}
+}
+
+func TestForRange(t *testing.T) {
+	expectOutput(t, "for i in 0..2 do print i;\n", "i = 0 (int)", "i = 1 (int)", "i = 2 (int)")
+	expectOutput(t, "for i in 3..3 do print i;\n", "i = 3 (int)")
+	expectOutput(t, "for i in 2..0 do print i;\n", "i = 2 (int)", "i = 1 (int)", "i = 0 (int)")
+}
+
+func TestHypotAndAtan2(t *testing.T) {
+	if got := evalText(t, "hypot(3, 4)"); got != "5" {
+		t.Errorf("hypot(3, 4) = %s", got)
+	}
+	tests := []struct {
+		y, x string
+		want float64
+	}{
+		{"1", "1", math.Pi / 4},
+		{"1", "-1", 3 * math.Pi / 4},
+		{"-1", "-1", -3 * math.Pi / 4},
+		{"-1", "1", -math.Pi / 4},
+	}
+	in, _, _ := newTestInterpreter()
+	for _, tt := range tests {
+		v, err := in.Eval("atan2(" + tt.y + ", " + tt.x + ")")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(v.Float()-tt.want) > 1e-12 {
+			t.Errorf("atan2(%s, %s) = %v, ожидалось %v", tt.y, tt.x, v.Float(), tt.want)
+		}
+	}
+	expectError(t, "x = hypot(1);\n", "Функция hypot ожидала 2 аргументов, передано 1")
+}
+
+func TestFunctionsSortedJSON(t *testing.T) {
+	const src = "b(x): x + 1;\nc(): 42;\na(y:i, z): y * z;\nfunctions;\n"
+	jsonMode := func(in *Interpreter) { in.jsonOutput = true }
+	want := `[{"name":"a","params":[{"name":"y","type":"int"},{"name":"z"}],"body":"y * z"},` +
+		`{"name":"b","params":[{"name":"x"}],"body":"x + 1"},` +
+		`{"name":"c","params":[],"body":"42"}]` + "\n"
+	for i := 0; i < 5; i++ {
+		out, errs := run(t, src, jsonMode)
+		if errs != "" {
+			t.Fatalf("ошибки: %s", errs)
+		}
+		if out != want {
+			t.Fatalf("вывод:\n%s\nожидалось:\n%s", out, want)
+		}
+	}
+	expectOutput(t, src, "== Список всех функций ==", "a(y:i, z): y * z", "b(x): x + 1", "c(): 42")
+}
+
+func TestBreakAndContinue(t *testing.T) {
+	expectOutput(t, "i = 0;\nwhile (1) do break;\nprint i;\n", "i = 0 (int)")
+	expectOutput(t, "for i in 0..100 do break;\nprint i;\n", "i = 0 (int)")
+	// break завершает только ближайший цикл
+	expectOutput(t, "for i in 0..2 do for j in 0..9 do break;\nprint i, j;\n", "2 0")
+	// continue переходит к следующей итерации, не прерывая цикл
+	expectOutput(t, "repeat 3 do continue;\nfor j in 0..4 do continue;\nprint j;\n", "j = 4 (int)")
+	expectError(t, "break;\n", "ОШИБКА: break вне цикла")
+	expectError(t, "continue;\n", "ОШИБКА: continue вне цикла")
+}
+
+func TestComparisonStoredAsInt(t *testing.T) {
+	in, _, errs := newTestInterpreter()
+	runProgram(t, in, "x = 7;\nflag(i) = x > 5;\nnone(i) = x < 5;\ninferred = x == 7;\n")
+	if errs.Len() != 0 {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	for name, want := range map[string]string{"flag": "1", "none": "0", "inferred": "1"} {
+		v := value(t, in, name)
+		if !v.IsInt() || v.String() != want {
+			t.Errorf("%s = %v (%s), ожидалось %s (int)", name, v, typeName(v), want)
+		}
+	}
+}
+
+func TestInteractiveAfterFile(t *testing.T) {
+	in, out, errs := newTestInterpreter()
+	runProgram(t, in, "x = 5;\nf(a): a + 1;\n")
+	if err := in.repl(strings.NewReader("print x;\necho f(x);\n")); err != nil {
+		t.Fatal(err)
+	}
+	if errs.Len() != 0 {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	for _, want := range []string{"> x = 5 (int)\n", "> 6\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("в выводе нет %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestCommentInFunctionBody(t *testing.T) {
+	expectOutput(t, "f(x): x + 1 # плюс один\n;\ng(x): { x # первое слагаемое\n + 3\n}\necho f(1);\necho g(1);\n",
+		"2", "4")
+}
+
+func TestEcho(t *testing.T) {
+	expectOutput(t, "echo 2+2;\necho 1/3;\nx = 7;\necho x;\n", "4", "0.3333333333333333", "7")
+}
+
+func TestNaNComparisons(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	runProgram(t, in, "n = 0/0;\n")
+	for _, op := range []string{"<", "<=", ">", ">=", "==", "!="} {
+		want := 0.0
+		if op == "!=" {
+			want = 1
+		}
+		for _, expr := range []string{"n " + op + " 1", "1 " + op + " n", "n " + op + " n"} {
+			v, err := in.Eval(expr)
+			if err != nil {
+				t.Fatalf("%s: %v", expr, err)
+			}
+			if v.Float() != want {
+				t.Errorf("%s = %v, ожидалось %v", expr, v.Float(), want)
+			}
+		}
+	}
+}
+
+func TestStrictTypes(t *testing.T) {
+	strict := func(in *Interpreter) { in.strictTypes = true }
+	expectError(t, "x(i) = 2;\ny = 1.5;\nz = x + y;\n", "Смешение int и float без явного приведения", strict)
+	expectOutput(t, "x(i) = 2;\ny = 1.5;\nz = x + y;\nprint z;\n", "z = 3.5 (float)")
+	out, errs := run(t, "x(i) = 2;\ny = 1.5;\nw = float(x) + y;\nprint w;\n", strict)
+	if errs != "" || out != "w = 3.5 (float)\n" {
+		t.Fatalf("вывод %q, ошибки %q", out, errs)
+	}
+}
+
+func TestPrintWidth(t *testing.T) {
+	expectOutput(t, "x(i) = 42;\ny = 3.5;\nprint x : 8;\nprint x : -8;\nprint y : 8;\nprint y : -8;\n",
+		"x =       42 (int)", "x = 42       (int)", "y =      3.5 (float)", "y = 3.5      (float)")
+}
+
+func TestCompose(t *testing.T) {
+	expectOutput(t, "inc(x): x + 1;\ndbl(x): x * 2;\nh = compose(dbl, inc);\necho h(3);\nk = compose(inc, dbl);\necho k(3);\n",
+		"8", "7")
+	expectError(t, "add(a, b): a + b;\ninc(x): x + 1;\nk = compose(add, inc);\n",
+		"Функция compose: аргументы должны быть функциями одного аргумента")
+	expectError(t, "inc(x): x + 1;\nk = compose(inc, 3);\n",
+		"Функция compose: аргументы должны быть функциями одного аргумента")
+}
+
+func TestStatsStatementCounts(t *testing.T) {
+	in, out, _ := newTestInterpreter()
+	in.statsEnabled = true
+	runProgram(t, in, "x = 1;\n\n# комментарий\ny = nope;\nz = x + 1;\nbreak;\n")
+	if in.stats.statements != 4 || in.stats.failedStatements != 2 {
+		t.Fatalf("инструкций: %d, с ошибками: %d", in.stats.statements, in.stats.failedStatements)
+	}
+	in.printStats()
+	if !strings.Contains(out.String(), "инструкций: 4 (успешно: 2, с ошибками: 2)") {
+		t.Fatalf("статистика:\n%s", out)
+	}
+}
+
+func TestEvenOdd(t *testing.T) {
+	expectOutput(t, "echo iseven(4);\necho isodd(4);\necho iseven(-3);\necho isodd(7);\n", "1", "0", "0", "1")
+	expectError(t, "x = iseven(2.5);\n", "Функция iseven: аргументы должны быть целыми числами")
+	expectError(t, "x = isodd(0.5);\n", "Функция isodd: аргументы должны быть целыми числами")
+}
+
+func TestColonAssign(t *testing.T) {
+	expectOutput(t, "x := 5;\nprint x;\nx := x = 5;\nprint x;\ny := x = 5;\nprint y;\n",
+		"x = 5 (int)", "x = 1 (int)", "y = 0 (int)")
+}
+
+func TestWrap(t *testing.T) {
+	tests := []struct{ expr, want string }{
+		{"wrap(370, 0, 360)", "10"},
+		{"wrap(-90, 0, 360)", "270"},
+		{"wrap(90, 0, 360)", "90"},
+		{"wrap(360, 0, 360)", "0"},
+		{"wrap(1.5, 0, 1)", "0.5"},
+	}
+	for _, tt := range tests {
+		if got := evalText(t, tt.expr); got != tt.want {
+			t.Errorf("%s = %s, ожидалось %s", tt.expr, got, tt.want)
+		}
+	}
+	expectError(t, "x = wrap(1, 5, 5);\n", "Функция wrap: нижняя граница 5 должна быть меньше верхней 5")
+	expectError(t, "x = wrap(1, 5, 0);\n", "Функция wrap: нижняя граница 5 должна быть меньше верхней 0")
+}
+
+func TestCheckFunctionsWarnsAboutUnknownNames(t *testing.T) {
+	check := func(in *Interpreter) { in.checkFunctions = true }
+	out, errs := run(t, "g = 1;\nh(x): x;\nf(x): x + y + g + h(x) + min(x, 1);\necho 1;\n", check)
+	if out != "1\n" {
+		t.Fatalf("вывод: %q", out)
+	}
+	want := "ПРЕДУПРЕЖДЕНИЕ: функция f: имя \"y\" не является параметром, функцией или переменной (опечатка?)\n"
+	if errs != want {
+		t.Fatalf("предупреждения:\n%s\nожидалось:\n%s", errs, want)
+	}
+	if _, errs := run(t, "f(x): x + y;\n"); errs != "" {
+		t.Fatalf("без --check-functions предупреждений быть не должно: %s", errs)
+	}
+}
+
+func TestShow(t *testing.T) {
+	expectOutput(t, "show 2 * 3;\nx = 5;\nshow x + 2;\nshow x / 2;\n", "2 * 3 = 6", "x + 2 = 7", "x / 2 = 2.5")
+}
+
+func TestRecursionDepthLimit(t *testing.T) {
+	in, out, errs := newTestInterpreter()
+	in.maxDepth = 50
+	runProgram(t, in, "f(x): f(x + 1);\ny = f(1);\necho 1;\n")
+	if !strings.Contains(errs.String(), "превышена глубина рекурсии 50 при вызове функции f") {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	// после ошибки выполнение продолжается со следующей инструкции
+	if out.String() != "1\n" {
+		t.Fatalf("вывод: %q", out)
+	}
+}
+
+func TestMemoize(t *testing.T) {
+	// без условного оператора рекурсия не останавливается, поэтому вместо fib –
+	// цепочка, в которой каждая функция дважды вызывает предыдущую: без кэша
+	// тело f0 вычисляется 2^5 раз, с кэшем – один раз
+	const defs = "f0(n): n + 1;\nf1(n): f0(n) + f0(n);\nf2(n): f1(n) + f1(n);\n" +
+		"f3(n): f2(n) + f2(n);\nf4(n): f3(n) + f3(n);\nf5(n): f4(n) + f4(n);\n"
+	calls := func(memo string) (Value, map[string]int) {
+		in, _, errs := newTestInterpreter()
+		in.statsEnabled = true
+		runProgram(t, in, defs+memo+"x = f5(1);\n")
+		if errs.Len() != 0 {
+			t.Fatalf("ошибки: %s", errs)
+		}
+		return value(t, in, "x"), in.stats.funcCalls
+	}
+	plain, plainCalls := calls("")
+	memo, memoCalls := calls("memoize f0;\nmemoize f1;\nmemoize f2;\nmemoize f3;\nmemoize f4;\n")
+	if plain.Float() != 64 || memo.Float() != 64 {
+		t.Fatalf("f5(1) = %v без кэша и %v с кэшем, ожидалось 64", plain, memo)
+	}
+	if plainCalls["f0"] != 32 || memoCalls["f0"] != 1 || memoCalls["f4"] != 1 {
+		t.Fatalf("вызовы без кэша: %v, с кэшем: %v", plainCalls, memoCalls)
+	}
+}
+
+func TestMemoizeCacheHitsNotCounted(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	in.statsEnabled = true
+	runProgram(t, in, "f(n): n * 2;\nmemoize f;\nx = f(1) + f(1) + f(1);\n")
+	// оба счётчика считают только вычисления тела
+	if in.stats.calls != 1 || in.stats.funcCalls["f"] != 1 {
+		t.Fatalf("calls %d, funcCalls %v", in.stats.calls, in.stats.funcCalls)
+	}
+}
+
+func TestSnapshotCopiesMemoCache(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	runProgram(t, in, "f(n): n * 2;\nmemoize f;\n")
+	snap := in.Snapshot()
+	for i := 0; i < 2; i++ {
+		runProgram(t, in, "x = f(1) + f(2);\n")
+		if n := len(in.functions["f"].memo); n != 2 {
+			t.Fatalf("в кэше %d значений", n)
+		}
+		in.Restore(snap)
+		if n := len(in.functions["f"].memo); n != 0 {
+			t.Fatalf("после Restore в кэше %d значений", n)
+		}
+	}
+}
+
+func TestTypedInput(t *testing.T) {
+	in, out, errs := newTestInterpreter()
+	in.In = strings.NewReader("3.9\n3.9\n3.9\nabc\n")
+	runProgram(t, in, "input a(i);\ninput b(f);\ninput c;\ninput d;\nprint a;\nprint b;\nprint c;\n")
+	if got := strings.Join(lines(out.String()), "\n"); got != "a = 3 (int)\nb = 3.9 (float)\nc = 3.9 (float)" {
+		t.Fatalf("вывод:\n%s", got)
+	}
+	if errs.Len() == 0 {
+		t.Fatal("нечисловой ввод должен быть ошибкой")
+	}
+}
+
+func TestSciOutput(t *testing.T) {
+	const src = "a = 12345678.0;\nb = 0.00001234;\nc = 123.5;\nd(i) = 123456789;\n" +
+		"print a;\nprint b;\nprint c;\nprint d;\n"
+	out, _ := run(t, src, func(in *Interpreter) { in.sci = true })
+	if got := strings.Join(lines(out), "\n"); got != "a = 1.2345678e+07 (float)\nb = 1.234e-05 (float)\n"+
+		"c = 123.5 (float)\nd = 123456789 (int)" {
+		t.Fatalf("вывод --sci:\n%s", got)
+	}
+	// порог настраивается: при 100 в экспоненциальной записи и 123.5
+	out, _ = run(t, src, func(in *Interpreter) { in.sci, in.sciThreshold = true, 100 })
+	if !strings.Contains(out, "c = 1.235e+02 (float)") {
+		t.Fatalf("вывод --sci-threshold 100:\n%s", out)
+	}
+	expectOutput(t, src, "a = 12345678 (float)", "b = 1.234e-05 (float)", "c = 123.5 (float)", "d = 123456789 (int)")
+}
+
+func TestCountVarsAndFuncs(t *testing.T) {
+	expectOutput(t, "echo count_vars();\necho count_funcs();\na = 1;\nb = 2;\nc = [1];\n"+
+		"f(x): x;\ng(): 1;\necho count_vars();\necho count_funcs();\n", "0", "0", "3", "2")
+	expectError(t, "x = count_vars(1);\n", "Функция count_vars ожидала 0 аргументов, передано 1")
+}
+
+func TestLetIsLocalToLoopBody(t *testing.T) {
+	in, out, errs := newTestInterpreter()
+	runProgram(t, in, "t = 100;\nrepeat 3 do let t = 5;\nrepeat 2 do let u = 1;\nfor i in 1..3 do let s = i;\nprint t;\n")
+	if errs.Len() != 0 {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	if out.String() != "t = 100 (int)\n" {
+		t.Fatalf("внешняя переменная изменилась: %q", out)
+	}
+	for _, name := range []string{"u", "s"} {
+		if _, ok := in.getVariable(name); ok {
+			t.Errorf("let в теле цикла создал глобальную переменную %s", name)
+		}
+	}
+	// вне цикла let – обычное присваивание
+	expectOutput(t, "let w = 3;\nprint w;\n", "w = 3 (int)")
+}
+
+func TestDegreesRadians(t *testing.T) {
+	in, _, _ := newTestInterpreter()
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"radians(180)", math.Pi},
+		{"degrees(3.141592653589793)", 180},
+		{"degrees(radians(180))", 180},
+		{"radians(degrees(3.141592653589793))", math.Pi},
+		{"radians(90)", math.Pi / 2},
+	}
+	for _, tt := range tests {
+		v, err := in.Eval(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		if math.Abs(v.Float()-tt.want) > 1e-12 {
+			t.Errorf("%s = %v, ожидалось %v", tt.expr, v.Float(), tt.want)
+		}
+	}
+}
+
+func TestTypedInitFromCall(t *testing.T) {
+	in, _, errs := newTestInterpreter()
+	runProgram(t, in, "f(x): x * 1.5;\ny(i) = f(3);\nz(i) = nof(3);\n")
+	if y := value(t, in, "y"); !y.IsInt() || y.String() != "4" {
+		t.Errorf("y = %v (%s), ожидалось 4 (int)", y, typeName(y))
+	}
+	if !strings.Contains(errs.String(), `использование не объявленной функции "nof"`) {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	if _, ok := in.getVariable("z"); ok {
+		t.Fatal("при вызове необъявленной функции переменная не должна создаваться")
+	}
+}
+
+func TestColor(t *testing.T) {
+	const src = "echo 2 + 2;\nx = nope;\n"
+	out, errs := run(t, src, func(in *Interpreter) { in.color = true })
+	if out != colorGreen+"4"+colorReset+"\n" {
+		t.Errorf("результат с --color: %q", out)
+	}
+	if !strings.HasPrefix(errs, colorRed+"ОШИБКА") || !strings.HasSuffix(errs, colorReset+"\n") {
+		t.Errorf("ошибка с --color: %q", errs)
+	}
+	out, errs = run(t, src)
+	if strings.Contains(out+errs, "\x1b[") {
+		t.Errorf("без --color не должно быть ANSI-последовательностей: %q %q", out, errs)
+	}
+	// --color включается, только если вывод идёт в терминал, а не в файл
+	f, err := os.Open(writeProgram(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if isTerminal(f) {
+		t.Error("файл распознан как терминал")
+	}
+}
+
+func TestTruncatedAndFlooredRemainder(t *testing.T) {
+	tests := []struct{ expr, want string }{
+		{"-7 % 3", "-1"},
+		{"-7 mod 3", "2"},
+		{"7 % -3", "1"},
+		{"7 mod -3", "-2"},
+		{"7 % 3", "1"},
+		{"7 mod 3", "1"},
+		{"7.5 mod 2", "1.5"},
+	}
+	for _, tt := range tests {
+		if got := evalText(t, tt.expr); got != tt.want {
+			t.Errorf("%s = %s, ожидалось %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	in, out, errs := newTestInterpreter()
+	runProgram(t, in, "f(a, b): a * b + 0.5;\nprobe f(2, 3);\n")
+	if errs.Len() != 0 || out.String() != "f(2, 3) -> 6.5\n" {
+		t.Fatalf("вывод %q, ошибки %q", out, errs)
+	}
+	if _, ok := in.getVariable("f"); ok {
+		t.Fatal("probe не должен ничего присваивать")
+	}
+	expectError(t, "probe 1+1;\n", "ОШИБКА: probe ожидает вызов функции")
+}
+
+func TestEmptyStatements(t *testing.T) {
+	for _, src := range []string{";\n", ";;\n", "  ;  \n", "\n", "x = 1;;\n"} {
+		if n := errorCount(t, src); n != 0 {
+			t.Errorf("%q: ошибок %d, ожидалась пустая инструкция", src, n)
+		}
+	}
+	expectOutput(t, ";\n;;\n  ;  \nx = 1;;\nprint x;\n", "x = 1 (int)")
+}
+
+func TestExactIntegerPower(t *testing.T) {
+	in, _, errs := newTestInterpreter()
+	runProgram(t, in, "x(i) = 2;\ny(i) = x^53;\nz(i) = x^62;\nw = 3^39 + 1;\nv = 2^64;\n")
+	if errs.Len() != 0 {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	for name, want := range map[string]string{
+		"y": "9007199254740992", "z": "4611686018427387904", "w": "4052555153018976268",
+	} {
+		if v := value(t, in, name); !v.IsInt() || v.String() != want {
+			t.Errorf("%s = %v (%s), ожидалось %s", name, v, typeName(v), want)
+		}
+	}
+	// за пределами int64 результат вещественный
+	if v := value(t, in, "v"); v.IsInt() || v.Float() != math.Pow(2, 64) {
+		t.Errorf("v = %v (%s)", v, typeName(v))
+	}
+}
+
+func TestAssertError(t *testing.T) {
+	out, errs := run(t, "assert_error undefined_func();\nassert_error x = nope;\necho 5;\n")
+	if errs != "" || out != "5\n" {
+		t.Fatalf("ожидаемые ошибки не должны выводиться: вывод %q, ошибки %q", out, errs)
+	}
+	if n := errorCount(t, "assert_error undefined_func();\n"); n != 0 {
+		t.Fatalf("выполненная проверка учтена как %d ошибок", n)
+	}
+	strict := func(in *Interpreter) { in.strictTypes = true }
+	if _, errs := run(t, "x(i) = 1;\nassert_error x + 1.5;\n", strict); errs != "" {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	expectError(t, "assert_error 1 + 1;\n", "ОШИБКА: проверка не выполнена: ожидалась ошибка: 1 + 1")
+}
+
+func TestEnvAndEnvnum(t *testing.T) {
+	t.Setenv("CALC_TEST_N", "42")
+	t.Setenv("CALC_TEST_S", "abc")
+	os.Unsetenv("CALC_TEST_UNSET")
+	expectOutput(t, "x = envnum(\"CALC_TEST_N\");\nprint x;\necho env(\"CALC_TEST_S\");\n", "x = 42 (int)", "abc")
+	expectError(t, "x = envnum(\"CALC_TEST_UNSET\");\n", "Функция envnum: переменная окружения CALC_TEST_UNSET не задана")
+	expectError(t, "x = env(\"CALC_TEST_UNSET\");\n", "Функция env: переменная окружения CALC_TEST_UNSET не задана")
+	expectError(t, "x = envnum(\"CALC_TEST_S\");\n", "Функция envnum: переменная окружения CALC_TEST_S – не число")
+}
+
+func TestMaxVariables(t *testing.T) {
+	limit := func(in *Interpreter) { in.maxVariables = 2 }
+	// ниже ограничения и при присваивании существующей переменной ошибок нет
+	in, _, errs := newTestInterpreter()
+	limit(in)
+	runProgram(t, in, "a = 1;\nb = 2;\na = 3;\nf(x): x;\ng(x): x;\nf(x): x + 1;\n")
+	if errs.Len() != 0 {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	expectError(t, "a = 1;\nb = 2;\nc = 3;\n",
+		"ОШИБКА: нельзя создать переменную c: достигнуто ограничение 2 переменных (флаг --max-variables)", limit)
+	expectError(t, "f(x): x;\ng(x): x;\nh(x): x;\n", "нельзя создать функцию h", limit)
+	if n := errorCount(t, "a = 1;\nb = 2;\nc = 3;\nd = 4;\n"); n != 0 {
+		t.Fatalf("без ограничения ошибок быть не должно: %d", n)
+	}
+}
+
+func TestShowSign(t *testing.T) {
+	out, _ := run(t, "a = 5;\nb = -3;\nc = 0;\nd = 2.5;\nprint a;\nprint b;\nprint c;\nprint d;\necho 7;\n",
+		func(in *Interpreter) { in.showSign = true })
+	want := "a = +5 (int)\nb = -3 (int)\nc = 0 (int)\nd = +2.5 (float)\n+7"
+	if got := strings.Join(lines(out), "\n"); got != want {
+		t.Fatalf("вывод:\n%s\nожидалось:\n%s", got, want)
+	}
+	expectOutput(t, "a = 5;\nprint a;\n", "a = 5 (int)")
+}
+
+func TestHistogram(t *testing.T) {
+	expectOutput(t, "a = [1, 2, 2, 3, 3, 3, 10];\nhistogram(a, 3);\n",
+		"[1, 4) 6 ######", "[4, 7) 0", "[7, 10] 1 #")
+	expectError(t, "e = [];\nhistogram(e, 3);\n", `ОШИБКА: histogram: массив "e" пуст`)
+	expectError(t, "a = [1, 2];\nhistogram(a, 0);\n", "ОШИБКА: histogram: число интервалов должно быть от 1 до 1000, получено 0")
+}
+
+func TestClearFunctionsAndVars(t *testing.T) {
+	in, _, errs := newTestInterpreter()
+	runProgram(t, in, "a = 1;\nf(x): x;\nclear functions;\n")
+	if _, ok := in.getVariable("a"); !ok || len(in.functions) != 0 {
+		t.Fatalf("clear functions: переменных %d, функций %d", len(in.variables), len(in.functions))
+	}
+	runProgram(t, in, "g(x): x;\nclear vars;\n")
+	if _, ok := in.functions["g"]; !ok || len(in.variables) != 0 {
+		t.Fatalf("clear vars: переменных %d, функций %d", len(in.variables), len(in.functions))
+	}
+	runProgram(t, in, "b = 1;\nreset;\n")
+	if len(in.variables) != 0 || len(in.functions) != 0 {
+		t.Fatalf("reset: переменных %d, функций %d", len(in.variables), len(in.functions))
+	}
+	if errs.Len() != 0 {
+		t.Fatalf("ошибки: %s", errs)
+	}
+}
+
+func TestMultiLineFunctionBody(t *testing.T) {
+	expectOutput(t, "f(x, y): {\n  x * 2\n  + y\n}\necho f(3, 1);\n", "7")
+	expectError(t, "g(x): {\n  x\n", "ОШИБКА: фигурная скобка не закрыта до конца файла: g(x): {")
+}
+
+// cacheProgram – цикл, вычисляющий одни и те же выражения на каждой итерации
+const cacheProgram = "s = 0;\ni = 0;\nwhile (i < 200) do i = i + 1;\nrepeat 200 do s = s + i * 2 - 1;\nprint s;\n"
+
+// runCached – выполняет cacheProgram со статистикой; capacity 0 отключает кэш выражений
+func runCached(t testing.TB, capacity int) (string, int, int) {
+	in, out, errs := newTestInterpreter()
+	in.statsEnabled = true
+	in.parsed = newExprCache(capacity)
+	path := filepath.Join(t.TempDir(), "prog.txt")
+	if err := os.WriteFile(path, []byte(cacheProgram), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := in.runFile(path); err != nil || errs.Len() != 0 {
+		t.Fatalf("runFile: %v %s", err, errs)
+	}
+	return out.String(), in.stats.parses, in.stats.cacheHits
+}
+
+func TestExprCache(t *testing.T) {
+	cachedOut, cachedParses, hits := runCached(t, exprCacheSize)
+	plainOut, plainParses, _ := runCached(t, 0)
+	if cachedOut != plainOut || cachedOut != "s = 79800 (int)\n" {
+		t.Fatalf("с кэшем %q, без кэша %q", cachedOut, plainOut)
+	}
+	// каждое выражение разбирается один раз, остальные вычисления берут дерево из кэша
+	if cachedParses > 10 || hits < 400 || plainParses < 400 {
+		t.Fatalf("разборов с кэшем %d (из кэша %d), без кэша %d", cachedParses, hits, plainParses)
+	}
+}
+
+func TestExprCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newExprCache(2)
+	a, b, d := &Node{}, &Node{}, &Node{}
+	c.put("a", a)
+	c.put("b", b)
+	c.get("a") // "b" становится давно не использованным
+	c.put("d", d)
+	if _, ok := c.get("b"); ok {
+		t.Error("давно не использованное дерево не вытеснено")
+	}
+	if root, ok := c.get("a"); !ok || root != a {
+		t.Error("недавно использованное дерево вытеснено")
+	}
+	if root, ok := c.get("d"); !ok || root != d {
+		t.Error("новое дерево не добавлено")
+	}
+}
+
+func benchmarkExprCache(b *testing.B, capacity int) {
+	var parses int
+	for i := 0; i < b.N; i++ {
+		_, n, _ := runCached(b, capacity)
+		parses += n
+	}
+	b.ReportMetric(float64(parses)/float64(b.N), "parses/op")
+}
+
+func BenchmarkLoopWithExprCache(b *testing.B)    { benchmarkExprCache(b, exprCacheSize) }
+func BenchmarkLoopWithoutExprCache(b *testing.B) { benchmarkExprCache(b, 0) }
+
+func TestMaxLineLength(t *testing.T) {
+	// строка длиннее стандартного предела bufio.Scanner (64 КБ), но в пределах --max-line-length
+	long := "x = 1; # " + strings.Repeat("a", 100*1024) + "\nprint x;\n"
+	expectOutput(t, long, "x = 1 (int)")
+
+	tests := []struct {
+		name, src string
+		limit     int
+		want      string
+	}{
+		{"default", "y = 2;\nx = 1; # " + strings.Repeat("a", 1<<20) + "\n", 1 << 20,
+			"строка 2 слишком длинная: больше 1048576 байт (флаг --max-line-length)"},
+		{"small", "y = 2;\nx = 12345678901234567890;\n", 16,
+			"строка 2 слишком длинная: больше 16 байт (флаг --max-line-length)"},
+		{"block", "y = 2;\nf(x): {\n  x\n  + 12345678901234567890\n}\n", 16,
+			"строка 4 слишком длинная: больше 16 байт (флаг --max-line-length)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, _, _ := newTestInterpreter()
+			in.maxLineLength = tt.limit
+			err := in.runFile(writeProgram(t, tt.src))
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("ошибка %v, ожидалось %q", err, tt.want)
+			}
+			// строки до слишком длинной выполнены
+			if y := value(t, in, "y"); y.String() != "2" {
+				t.Fatalf("y = %v", y)
+			}
+		})
+	}
+}
+
+func TestFunctionDispatchTable(t *testing.T) {
+	expectOutput(t, "sq(x): x * x;\ncube(x): x ^ 3;\nfs(arr) = [sq, cube];\necho fs[0](3);\necho fs[1](3);\n"+
+		"inc = lambda(x): x + 1;\ngs = [inc, sq];\necho gs[0](gs[1](4));\n", "9", "27", "17")
+	expectError(t, "k = [1, 2];\necho k[0](3);\n", "Значение типа int не является функцией")
+	expectError(t, "sq(x): x * x;\nfs = [sq];\necho fs[5](1);\n", "Индекс 5 вне границ массива fs (длина 1)")
+}
+
+func TestFunctionArrayInNumericBuiltins(t *testing.T) {
+	const defs = "sq(x): x * x;\ncube(x): x ^ 3;\nfs(arr) = [sq, cube];\n"
+	expectError(t, defs+"i = argmin(fs);\n", "Функция argmin: элементы массива должны быть числами")
+	expectError(t, defs+"i = argmax(fs);\n", "Функция argmax: элементы массива должны быть числами")
+	expectError(t, defs+"x = max(fs[0], 1);\n", "Функция max: аргументы должны быть числами")
+	expectError(t, defs+"x = min(sq, 1);\n", "Функция min: аргументы должны быть числами")
+	expectError(t, defs+"histogram(fs, 2);\n", "histogram: элементы массива должны быть числами")
+	// при ошибке порядок элементов не меняется
+	out, errs := run(t, defs+"sort(fs);\necho fs[0](2);\n")
+	if !strings.Contains(errs, "sort: элементы массива должны быть числами") || out != "4\n" {
+		t.Fatalf("вывод %q, ошибки %q", out, errs)
+	}
+}
+
+func TestProfileOrdersByCumulativeTime(t *testing.T) {
+	in, out, errs := newTestInterpreter()
+	in.profileEnabled = true
+	// время heavy включает время вызываемых из неё mid и light, поэтому heavy – первая
+	runProgram(t, in, "light(x): x + 1;\nmid(x): light(x) * light(x);\n"+
+		"heavy(x): mid(x) + mid(x + 1) + mid(x + 2);\nrepeat 50 do y = heavy(1);\n")
+	if errs.Len() != 0 {
+		t.Fatalf("ошибки: %s", errs)
+	}
+	in.printProfile()
+	got := lines(out.String())
+	if len(got) != 4 || got[0] != "== Профиль функций ==" {
+		t.Fatalf("профиль:\n%s", out)
+	}
+	if !strings.HasPrefix(got[1], "heavy: ") || !strings.HasSuffix(got[1], "(вызовов: 50)") {
+		t.Errorf("первой должна быть heavy: %s", got[1])
+	}
+	if !strings.HasSuffix(got[2], "(вызовов: 150)") || !strings.HasSuffix(got[3], "(вызовов: 300)") {
+		t.Errorf("порядок mid, light: %s; %s", got[2], got[3])
+	}
+	if in.profile["heavy"].total < in.profile["mid"].total || in.profile["mid"].total < in.profile["light"].total {
+		t.Errorf("суммарное время не убывает: %v", out)
+	}
+}
+
+func TestPlainFloatOutput(t *testing.T) {
+	const src = "a = 1000000.0;\nb = 0.125;\nc = 1234567.5;\nd = 1e20;\ne = -2500000.0;\n" +
+		"print a;\nprint b;\nprint c;\nprint d;\nprint e;\n"
+	expectOutput(t, src, "a = 1000000 (float)", "b = 0.125 (float)", "c = 1234567.5 (float)",
+		"d = 1e+20 (float)", "e = -2500000 (float)")
+	// граница настраивается флагом --plain-max
+	out, _ := run(t, "d = 1e20;\nprint d;\n", func(in *Interpreter) { in.plainMax = 1e21 })
+	if out != "d = 100000000000000000000 (float)\n" {
+		t.Fatalf("вывод с --plain-max 1e21: %q", out)
+	}
+}
+
+func TestBetween(t *testing.T) {
+	tests := []struct{ expr, want string }{
+		{"between(1, 2, 5)", "0"},
+		{"between(2, 2, 5)", "1"},
+		{"between(3, 2, 5)", "1"},
+		{"between(5, 2, 5)", "1"},
+		{"between(6, 2, 5)", "0"},
+		{"between_exclusive(1, 2, 5)", "0"},
+		{"between_exclusive(2, 2, 5)", "0"},
+		{"between_exclusive(3, 2, 5)", "1"},
+		{"between_exclusive(5, 2, 5)", "0"},
+		{"between_exclusive(6, 2, 5)", "0"},
+	}
+	for _, tt := range tests {
+		if got := evalText(t, tt.expr); got != tt.want {
+			t.Errorf("%s = %s, ожидалось %s", tt.expr, got, tt.want)
+		}
+	}
+}